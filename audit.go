@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// auditEntry describes a single resolution decision.
+type auditEntry struct {
+	Time             time.Time `json:"time"`
+	ClientIP         string    `json:"client_ip"`
+	Package          string    `json:"package"`
+	Subpackage       string    `json:"subpackage,omitempty"`
+	RequestedVersion string    `json:"requested_version"`
+	ResolvedVersion  string    `json:"resolved_version"`
+	ResolvedCommit   string    `json:"resolved_commit"`
+}
+
+// auditLogger writes a sample of resolution decisions to a dedicated sink,
+// one JSON object per line.
+type auditLogger struct {
+	mu   sync.Mutex
+	enc  *json.Encoder
+	rate float64
+
+	// random and now are replaced in tests.
+	random func() float64
+	now    func() time.Time
+}
+
+// newAuditLogger creates an audit logger that records roughly rate (0 to 1)
+// of all the entries it is given into w.
+func newAuditLogger(w io.Writer, rate float64) *auditLogger {
+	return &auditLogger{
+		enc:    json.NewEncoder(w),
+		rate:   rate,
+		random: rand.Float64,
+		now:    time.Now,
+	}
+}
+
+// Record writes the entry to the audit sink if it is picked by sampling. A
+// nil auditLogger records nothing.
+func (a *auditLogger) Record(entry auditEntry) {
+	if a == nil || a.rate <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rate < 1 && a.random() >= a.rate {
+		return
+	}
+	entry.Time = a.now().UTC()
+	if err := a.enc.Encode(entry); err != nil {
+		logger.Error(fmt.Sprintf("Audit: %v", err))
+	}
+}
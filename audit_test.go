@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditSampleRate(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+		testHash("4")+" refs/tags/v1.2.0",
+		testHash("5")+" refs/tags/v1.2.0^{}",
+	))
+
+	tests := []struct {
+		summary string
+		rate    float64
+		entries int
+	}{
+		{"Everything is recorded at rate 1", 1, 10},
+		{"Nothing is recorded at rate 0", 0, 0},
+		{"A quarter is recorded at rate 0.25", 0.25, 3},
+	}
+
+	defer func() { auditLog = nil }()
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		auditLog = newAuditLogger(&buf, test.rate)
+
+		// Cycle through 0.0, 0.1, ... 0.9 instead of random numbers.
+		n := 0
+		auditLog.random = func() float64 {
+			n++
+			return float64((n-1)%10) / 10
+		}
+		now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		auditLog.now = func() time.Time { return now }
+
+		for i := 0; i < 10; i++ {
+			if resp := serve(root, "/db.v1?go-get=1"); resp.Code != 200 {
+				t.Fatalf("%s: unexpected status %d: %s", test.summary, resp.Code, resp.Body)
+			}
+		}
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if buf.Len() == 0 {
+			lines = nil
+		}
+		if len(lines) != test.entries {
+			t.Fatalf("%s: got %d entries, want %d", test.summary, len(lines), test.entries)
+		}
+
+		for _, line := range lines {
+			var entry auditEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("%s: %v", test.summary, err)
+			}
+			want := auditEntry{
+				Time:             now,
+				ClientIP:         "192.0.2.1",
+				Package:          "upper.io/db",
+				RequestedVersion: "v1",
+				ResolvedVersion:  "v1.2.0",
+				ResolvedCommit:   testHash("5"),
+			}
+			if entry != want {
+				t.Fatalf("%s: got entry %+v, want %+v", test.summary, entry, want)
+			}
+		}
+	}
+
+	// Behind a trusted proxy, the client is the one it forwarded for.
+	defer func(p []*net.IPNet) { trustedProxies = p }(trustedProxies)
+	trustedProxies, _ = parseProxies("192.0.2.1")
+	var buf bytes.Buffer
+	auditLog = newAuditLogger(&buf, 1)
+	req := httptest.NewRequest("GET", "/db.v1?go-get=1", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	newHandler(root)(httptest.NewRecorder(), req)
+	var entry auditEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.ClientIP != "203.0.113.9" {
+		t.Fatalf("got client IP %s behind a trusted proxy", entry.ClientIP)
+	}
+}
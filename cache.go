@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// refsEntry is the outcome of fetching the refs of a repository.
+type refsEntry struct {
+	data []byte
+	dumb bool
+	err  error
+
+	expires time.Time
+}
+
+// resolvedEntry is the outcome of rewriting the refs of a repository for a
+// requested version.
+type resolvedEntry struct {
+	changed  []byte
+	versions semver.Versions
+	err      error
+
+	// source are the refs the entry was resolved from.
+	source []byte
+}
+
+// maxResolvedVersions bounds the rewritten refs kept per repository, as
+// requests choose the versions (and constraints) they are resolved for.
+const maxResolvedVersions = 64
+
+// errFetchFailed is what requests waiting for a fetch get if it panics.
+var errFetchFailed = errors.New("refs fetch failed")
+
+// refsCall is a fetch in progress that concurrent requests wait for.
+type refsCall struct {
+	done  chan struct{}
+	entry refsEntry
+}
+
+// refsCache keeps fetched refs in memory, by repository root, so repeated
+// requests do not hit the git host every time.
+type refsCache struct {
+	mu      sync.Mutex
+	entries map[string]refsEntry
+	calls   map[string]*refsCall
+
+	// resolved holds rewritten refs by repository root and then by requested
+	// version, so each version is resolved once per fetch of the refs.
+	resolved map[string]map[string]resolvedEntry
+
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	// nextSweep is when expired entries are next removed, so entries for
+	// repositories that are never requested again do not pile up.
+	nextSweep time.Time
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// newRefsCache creates a cache that keeps refs for ttl, and remembers that a
+// repository does not exist for negativeTTL.
+func newRefsCache(ttl, negativeTTL time.Duration) *refsCache {
+	return &refsCache{
+		entries:     make(map[string]refsEntry),
+		calls:       make(map[string]*refsCall),
+		resolved:    make(map[string]map[string]resolvedEntry),
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+	}
+}
+
+// Get returns the entry cached for key, if it has not expired.
+func (c *refsCache) Get(key string) (refsEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key)
+}
+
+func (c *refsCache) get(key string) (refsEntry, bool) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return refsEntry{}, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		delete(c.resolved, key)
+		return refsEntry{}, false
+	}
+	return entry, true
+}
+
+// Set caches entry for key. Only successful fetches and missing repositories
+// are cached, the latter for the shorter negative TTL.
+func (c *refsCache) Set(key string, entry refsEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, entry)
+}
+
+func (c *refsCache) set(key string, entry refsEntry) {
+	switch {
+	case entry.err == nil && c.ttl > 0:
+		entry.expires = c.now().Add(c.ttl)
+	case entry.err == ErrNoRepo && c.negativeTTL > 0:
+		entry.expires = c.now().Add(c.negativeTTL)
+	default:
+		return
+	}
+	c.entries[key] = entry
+	delete(c.resolved, key)
+	c.sweep()
+}
+
+// sweep removes the expired entries, at most once per the shorter TTL.
+func (c *refsCache) sweep() {
+	now := c.now()
+	if now.Before(c.nextSweep) {
+		return
+	}
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			delete(c.resolved, key)
+		}
+	}
+	interval := c.ttl
+	if c.negativeTTL > 0 && (interval <= 0 || c.negativeTTL < interval) {
+		interval = c.negativeTTL
+	}
+	c.nextSweep = now.Add(interval)
+}
+
+// Fetch returns the entry cached for key, or calls fetch to obtain and cache
+// it. Concurrent calls for the same key share a single fetch.
+func (c *refsCache) Fetch(key string, fetch func() refsEntry) refsEntry {
+	c.mu.Lock()
+	if entry, ok := c.get(key); ok {
+		c.mu.Unlock()
+		return entry
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.entry
+	}
+	call := &refsCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	fetched := false
+	defer func() {
+		c.mu.Lock()
+		if fetched {
+			c.set(key, call.entry)
+		} else {
+			call.entry = refsEntry{err: errFetchFailed}
+		}
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.entry = fetch()
+	fetched = true
+	return call.entry
+}
+
+// Resolve returns the rewritten refs cached for key and version, or calls
+// resolve to obtain and cache them. Entries are kept only while they were
+// resolved from data, the refs currently cached for key.
+func (c *refsCache) Resolve(key, version string, data []byte, resolve func() resolvedEntry) resolvedEntry {
+	c.mu.Lock()
+	if entry, ok := c.resolved[key][version]; ok && bytes.Equal(entry.source, data) {
+		c.mu.Unlock()
+		return entry
+	}
+	c.mu.Unlock()
+
+	entry := resolve()
+	entry.source = data
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if refs, ok := c.entries[key]; ok && bytes.Equal(refs.data, data) {
+		if c.resolved[key] == nil || len(c.resolved[key]) >= maxResolvedVersions {
+			c.resolved[key] = make(map[string]resolvedEntry)
+		}
+		c.resolved[key][version] = entry
+	}
+	return entry
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefsCacheExpiration(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newRefsCache(time.Minute, 10*time.Second)
+	c.now = func() time.Time { return now }
+
+	c.Set("ok", refsEntry{data: []byte("refs")})
+	c.Set("missing", refsEntry{err: ErrNoRepo})
+	c.Set("failed", refsEntry{err: errors.New("bad gateway")})
+
+	tests := []struct {
+		summary string
+		elapsed time.Duration
+		key     string
+		found   bool
+	}{
+		{"Fresh entry", 0, "ok", true},
+		{"Fresh missing repository", 0, "missing", true},
+		{"Other errors are not cached", 0, "failed", false},
+		{"Missing repository expires first", 10 * time.Second, "missing", false},
+		{"Entry is still fresh", 59 * time.Second, "ok", true},
+		{"Entry expires", time.Minute, "ok", false},
+	}
+
+	start := now
+	for _, test := range tests {
+		now = start.Add(test.elapsed)
+		entry, found := c.Get(test.key)
+		if found != test.found {
+			t.Fatalf("%s: got found=%v, want %v", test.summary, found, test.found)
+		}
+		if found && test.key == "ok" && string(entry.data) != "refs" {
+			t.Fatalf("%s: unexpected data %q", test.summary, entry.data)
+		}
+	}
+}
+
+func TestRefsCacheSweeps(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newRefsCache(time.Minute, 10*time.Second)
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("missing%d", i), refsEntry{err: ErrNoRepo})
+	}
+	c.Set("ok", refsEntry{data: []byte("refs")})
+	for i := 0; i < 2*maxResolvedVersions; i++ {
+		c.Resolve("ok", fmt.Sprintf(">=%d", i), []byte("refs"), func() resolvedEntry { return resolvedEntry{} })
+	}
+	if n := len(c.resolved["ok"]); n > maxResolvedVersions {
+		t.Fatalf("kept %d resolved versions, want at most %d", n, maxResolvedVersions)
+	}
+
+	// Entries nobody asks for again are removed once they expired.
+	now = now.Add(10 * time.Second)
+	c.Set("other", refsEntry{data: []byte("refs")})
+	if len(c.entries) != 2 {
+		t.Fatalf("got %d entries after the sweep, want 2", len(c.entries))
+	}
+}
+
+func TestRefsCacheFetchPanics(t *testing.T) {
+	c := newRefsCache(time.Minute, 0)
+
+	started, release := make(chan bool), make(chan bool)
+	go func() {
+		defer func() { recover() }()
+		c.Fetch("db", func() refsEntry {
+			close(started)
+			<-release
+			panic("fetch failed")
+		})
+	}()
+	<-started
+
+	done := make(chan refsEntry)
+	go func() { done <- c.Fetch("db", func() refsEntry { return refsEntry{} }) }()
+	// Let the waiter pile up behind the first fetch.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case entry := <-done:
+		if entry.err != errFetchFailed {
+			t.Fatalf("got error %v, want %v", entry.err, errFetchFailed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter blocked after the fetch panicked")
+	}
+	if _, ok := c.Get("db"); ok {
+		t.Fatal("cached the outcome of a panicked fetch")
+	}
+}
+
+func TestRefsCacheCoalesces(t *testing.T) {
+	c := newRefsCache(time.Minute, 0)
+
+	var calls int32
+	release := make(chan bool)
+	fetch := func() refsEntry {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return refsEntry{data: []byte("refs")}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if entry := c.Fetch("db", fetch); string(entry.data) != "refs" {
+				t.Errorf("unexpected data %q", entry.data)
+			}
+		}()
+	}
+
+	// Let the goroutines pile up behind the first fetch.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("got %d upstream fetches, want 1", calls)
+	}
+}
+
+func TestFetchRefsCached(t *testing.T) {
+	defer func() { cache = nil }()
+	cache = newRefsCache(time.Minute, time.Minute)
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path != "/db.git/info/refs" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", smartContentType)
+		io.WriteString(w, reflines(
+			testHash("1")+" HEAD",
+			testHash("2")+" refs/tags/v1.0.0",
+			testHash("3")+" refs/tags/v1.0.0^{}",
+		))
+	}))
+	defer srv.Close()
+
+	root, err := NewRepoRoot(srv.URL, "https://upper.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := serve(root, "/db.v1?go-get=1"); resp.Code != 200 {
+			t.Fatalf("unexpected status %d: %s", resp.Code, resp.Body)
+		}
+		if resp := serve(root, "/missing.v1?go-get=1"); resp.Code != 404 {
+			t.Fatalf("unexpected status %d: %s", resp.Code, resp.Body)
+		}
+	}
+	if hits != 2 {
+		t.Fatalf("got %d upstream fetches, want 2", hits)
+	}
+}
+
+func TestRefsCacheResolvesPerVersion(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newRefsCache(time.Minute, 0)
+	c.now = func() time.Time { return now }
+
+	refs := []byte("refs")
+	c.Set("db", refsEntry{data: refs})
+
+	resolves := map[string]int{}
+	resolve := func(version string) resolvedEntry {
+		return c.Resolve("db", version, refs, func() resolvedEntry {
+			resolves[version]++
+			return resolvedEntry{changed: []byte(version)}
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, version := range []string{"v2", "v3"} {
+			if entry := resolve(version); string(entry.changed) != version {
+				t.Fatalf("%s: got %q", version, entry.changed)
+			}
+		}
+	}
+	if len(c.resolved["db"]) != 2 {
+		t.Fatalf("got %d cached resolutions, want 2", len(c.resolved["db"]))
+	}
+	if resolves["v2"] != 1 || resolves["v3"] != 1 {
+		t.Fatalf("got resolutions %v, want one per version", resolves)
+	}
+
+	// Fetching the refs again drops resolutions made from the old ones.
+	refs = []byte("new refs")
+	c.Set("db", refsEntry{data: refs})
+	resolve("v2")
+	if resolves["v2"] != 2 {
+		t.Fatalf("v2 was not resolved again after a refs update")
+	}
+	if _, ok := c.resolved["db"]["v3"]; ok {
+		t.Fatalf("v3 resolution survived a refs update")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("db"); ok || c.resolved["db"] != nil {
+		t.Fatalf("resolutions survived the refs entry")
+	}
+}
+
+func TestResolveRefsCached(t *testing.T) {
+	defer func() { cache = nil }()
+	cache = newRefsCache(time.Minute, time.Minute)
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v2.0.0^{}",
+		testHash("3")+" refs/tags/v3.0.0^{}",
+	))
+
+	heads := map[string]string{"/db.v2": testHash("2"), "/db.v3": testHash("3")}
+	for i := 0; i < 2; i++ {
+		for path, want := range heads {
+			resp := serve(root, path+"/info/refs?service=git-upload-pack")
+			if head, _ := refsHead(resp.Body.Bytes()); head != want {
+				t.Fatalf("%s: got HEAD %s, want %s", path, head, want)
+			}
+		}
+	}
+
+	resolved := cache.resolved[root.NewRepo("db").RepoRoot()]
+	if len(resolved) != 2 || resolved["v2"].changed == nil || resolved["v3"].changed == nil {
+		t.Fatalf("unexpected resolutions %v", resolved)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// encoders compress response bodies, by Content-Encoding name. Encoders that
+// need extra dependencies register themselves from files behind build tags.
+var encoders = map[string]func(w io.Writer) io.WriteCloser{
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+}
+
+// encodings are the response encodings offered when -compress is set, in
+// order of preference.
+var encodings []string
+
+// parseEncodings parses a comma-separated list of encodings, checking that
+// this build supports them.
+func parseEncodings(s string) ([]string, error) {
+	var list []string
+	for _, name := range splitList(s) {
+		name = strings.ToLower(name)
+		if _, ok := encoders[name]; !ok {
+			if name == "br" {
+				return nil, fmt.Errorf("br requires building with -tags brotli")
+			}
+			return nil, fmt.Errorf("unknown encoding %q", name)
+		}
+		list = append(list, name)
+	}
+	return list, nil
+}
+
+// negotiateEncoding returns the first of the offered encodings that the
+// Accept-Encoding header accepts, or an empty string for identity.
+func negotiateEncoding(accept string, offered []string) string {
+	qs := map[string]float64{}
+	for _, part := range splitList(accept) {
+		name, params := part, ""
+		if i := strings.Index(part, ";"); i >= 0 {
+			name, params = part[:i], part[i+1:]
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if v, err := strconv.ParseFloat(params[2:], 64); err == nil {
+				q = v
+			}
+		}
+		qs[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+	for _, name := range offered {
+		q, ok := qs[name]
+		if !ok {
+			q, ok = qs["*"]
+		}
+		if ok && q > 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// encodingWriter is a ResponseWriter whose writeBody responses are compressed
+// with the encoding negotiated for the request. Other writes (e.g.: streamed
+// git responses) pass through, without a Vary header.
+type encodingWriter struct {
+	http.ResponseWriter
+	encoding string
+}
+
+// withEncoding wraps resp so writeBody compresses responses to req, if
+// -compress is set.
+func withEncoding(resp http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	if len(encodings) == 0 {
+		return resp
+	}
+	return &encodingWriter{resp, negotiateEncoding(req.Header.Get("Accept-Encoding"), encodings)}
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (w *encodingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// encode compresses body, returning it unchanged if no encoding was
+// negotiated or it is smaller than -compress-min-size. The response varies
+// by Accept-Encoding either way.
+func (w *encodingWriter) encode(body []byte) []byte {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if w.encoding == "" || len(body) < *compressMinSizeFlag {
+		return body
+	}
+	var buf bytes.Buffer
+	enc := encoders[w.encoding](&buf)
+	if _, err := enc.Write(body); err != nil {
+		return body
+	}
+	if err := enc.Close(); err != nil {
+		return body
+	}
+	w.Header().Set("Content-Encoding", w.encoding)
+	return buf.Bytes()
+}
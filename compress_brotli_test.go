@@ -0,0 +1,40 @@
+//go:build brotli
+// +build brotli
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressBrotli(t *testing.T) {
+	defer func(e []string) { encodings = e }(encodings)
+	encodings = []string{"br", "gzip"}
+
+	root := fakeUpstream(t, manyTags(100))
+	target := "/db.v1/info/refs?service=git-upload-pack"
+
+	plain := serveEncoded(root, target, "")
+
+	resp := serveEncoded(root, target, "gzip, deflate, br")
+	if enc := resp.Header().Get("Content-Encoding"); enc != "br" {
+		t.Fatalf("got Content-Encoding %q, want br", enc)
+	}
+	if resp.Body.Len() >= plain.Body.Len() {
+		t.Fatalf("brotli body of %d bytes is not smaller than %d", resp.Body.Len(), plain.Body.Len())
+	}
+	body, err := ioutil.ReadAll(brotli.NewReader(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != plain.Body.String() {
+		t.Fatalf("decompressed body does not match:\n%s", body)
+	}
+
+	if enc := serveEncoded(root, target, "gzip").Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip fallback", enc)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept  string
+		offered []string
+		want    string
+	}{
+		{"", []string{"br", "gzip"}, ""},
+		{"gzip", []string{"br", "gzip"}, "gzip"},
+		{"gzip, br", []string{"br", "gzip"}, "br"},
+		{"gzip, br", []string{"gzip", "br"}, "gzip"},
+		{"br;q=0, gzip", []string{"br", "gzip"}, "gzip"},
+		{"GZIP;q=0.5", []string{"gzip"}, "gzip"},
+		{"*", []string{"br", "gzip"}, "br"},
+		{"*, br;q=0", []string{"br", "gzip"}, "gzip"},
+		{"identity", []string{"gzip"}, ""},
+		{"gzip", nil, ""},
+	}
+	for _, test := range tests {
+		if got := negotiateEncoding(test.accept, test.offered); got != test.want {
+			t.Errorf("%q offering %v: got %q, want %q", test.accept, test.offered, got, test.want)
+		}
+	}
+}
+
+func TestParseEncodings(t *testing.T) {
+	if list, err := parseEncodings("gzip, GZIP"); err != nil || len(list) != 2 || list[0] != "gzip" {
+		t.Fatalf("unexpected result %v, %v", list, err)
+	}
+	if _, err := parseEncodings("deflate"); err == nil {
+		t.Fatalf("accepted unknown encoding")
+	}
+}
+
+// manyTags returns a refs advertisement with n version tags, large enough to
+// be compressed.
+func manyTags(n int) string {
+	lines := []string{testHash("1") + " HEAD"}
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprintf("%s refs/tags/v1.0.%d^{}", testHash(fmt.Sprint(i+2)), i))
+	}
+	return reflines(lines...)
+}
+
+// serveEncoded is like serve, sending the given Accept-Encoding header.
+func serveEncoded(root *RepoRoot, target, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	req.Header.Set("Accept-Encoding", accept)
+	resp := httptest.NewRecorder()
+	newHandler(root)(resp, req)
+	return resp
+}
+
+func TestCompressGzip(t *testing.T) {
+	defer func(e []string) { encodings = e }(encodings)
+	encodings = []string{"gzip"}
+
+	root := fakeUpstream(t, manyTags(100))
+	target := "/db.v1/info/refs?service=git-upload-pack"
+
+	plain := serveEncoded(root, target, "")
+	if plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("compressed without Accept-Encoding")
+	}
+	if plain.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("missing Vary header")
+	}
+
+	resp := serveEncoded(root, target, "br, gzip")
+	if enc := resp.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", enc)
+	}
+	if resp.Header().Get("Content-Length") != fmt.Sprint(resp.Body.Len()) {
+		t.Fatalf("Content-Length %s does not match body of %d bytes", resp.Header().Get("Content-Length"), resp.Body.Len())
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != plain.Body.String() {
+		t.Fatalf("decompressed body does not match:\n%s", body)
+	}
+
+	small := serveEncoded(root, "/health-check", "gzip")
+	if small.Header().Get("Content-Encoding") != "" || small.Body.String() != "ok" {
+		t.Fatalf("compressed small response %q", small.Body)
+	}
+
+	defer func() { metrics = nil }()
+	metrics = newMetrics()
+	if vary := serveEncoded(root, metricsPath, "").Header().Get("Vary"); vary != "" {
+		t.Fatalf("got Vary %q for metrics", vary)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// Config holds the settings read from the -config file.
+type Config struct {
+	// Packages maps package names to their settings.
+	Packages map[string]*PackageConfig `json:"packages"`
+
+	// Roots lists additional pairs of vanity and repository roots, each with
+	// its own package settings.
+	Roots []*RootConfig `json:"roots"`
+
+	// Features enables or disables groups of features, by environment name
+	// and then by feature name (see featureGroups). The "default" environment
+	// applies to all environments.
+	Features map[string]map[string]bool `json:"features"`
+}
+
+// defaultEnv is the environment whose features apply to every environment.
+const defaultEnv = "default"
+
+// featureFlag is a flag that a feature sets to on when it is enabled and to
+// off when it is disabled. An empty value stands for the default of the flag.
+type featureFlag struct {
+	name, on, off string
+}
+
+// featureGroups maps feature names to the flags they control. The admin
+// feature does not set -admin-token, which is a secret and must be given on
+// the command line.
+var featureGroups = map[string][]featureFlag{
+	"goproxy":       {{"goproxy", "true", "false"}},
+	"dumb_protocol": {{"dumb-protocol", "true", "false"}, {"dumb-fallback", "true", "false"}},
+	"caching":       {{"cache-ttl", "", "0"}},
+	"metrics":       {{"metrics", "true", "false"}},
+	"admin":         {{"history-size", "100", "0"}},
+	"debug":         {{"log-level", "debug", ""}},
+}
+
+// RootConfig maps a vanity root to a repository root.
+type RootConfig struct {
+	// VanityRoot is the vanity root URL (e.g.: https://upper.io).
+	VanityRoot string `json:"vanity_root"`
+
+	// RepoRoot is the Git repository root URL (e.g.:
+	// https://github.com/upper).
+	RepoRoot string `json:"repo_root"`
+
+	// Packages maps package names under this root to their settings.
+	Packages map[string]*PackageConfig `json:"packages"`
+}
+
+// PackageConfig holds the settings of a single package.
+type PackageConfig struct {
+	// DefaultMajor is the major version unversioned requests resolve to.
+	// Zero keeps the default behavior.
+	DefaultMajor int64 `json:"default_major"`
+
+	// SourceRoot is the URL that go-source links point to (e.g.:
+	// https://git.example.org/upper/db), instead of the repository URL.
+	SourceRoot string `json:"source_root"`
+
+	// DefaultRef is the branch or tag that source links of unversioned
+	// requests point to, instead of master.
+	DefaultRef string `json:"default_ref"`
+
+	// Recommended is the version (e.g.: v4.1.2) unversioned requests resolve
+	// to instead of the latest one, as while a newer release soaks. Requests
+	// for a version and the listings of versions are unaffected.
+	Recommended string `json:"recommended"`
+
+	// RobotsTag is the X-Robots-Tag header sent with the HTML pages of the
+	// package instead of -robots-tag (e.g.: "all" to allow indexing).
+	RobotsTag string `json:"robots_tag"`
+
+	// Sunset is when the package is scheduled to be removed, as a date
+	// (e.g.: 2027-01-31) or an RFC 3339 time, announced in a Sunset header.
+	Sunset string `json:"sunset"`
+
+	// SunsetLink is the URL of a migration document, announced in a Link
+	// header with rel="sunset".
+	SunsetLink string `json:"sunset_link"`
+
+	// Hidden leaves the package out of listings, such as /packages, while
+	// it still resolves when requested.
+	Hidden bool `json:"hidden"`
+}
+
+// loadConfig reads a JSON configuration file.
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if err := checkPackages(cfg.Packages); err != nil {
+		return nil, err
+	}
+	for _, rc := range cfg.Roots {
+		if err := checkPackages(rc.Packages); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
+
+// checkPackages reports the first invalid setting found in packages.
+func checkPackages(packages map[string]*PackageConfig) error {
+	for name, pc := range packages {
+		if pc == nil {
+			continue
+		}
+		if pc.Recommended != "" {
+			if _, err := semver.NewVersion(strings.TrimPrefix(pc.Recommended, "v")); err != nil {
+				return fmt.Errorf("package %q has an invalid recommended version: %v", name, err)
+			}
+		}
+		if pc.Sunset != "" {
+			if _, err := parseSunset(pc.Sunset); err != nil {
+				return fmt.Errorf("package %q has an invalid sunset: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseSunset parses a sunset date (e.g.: 2027-01-31), taken as UTC
+// midnight, or an RFC 3339 time.
+func parseSunset(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// setSunset announces the sunset of the package in header, if it has one.
+func (pc *PackageConfig) setSunset(header http.Header) {
+	if pc.Sunset != "" {
+		if t, err := parseSunset(pc.Sunset); err == nil {
+			header.Set("Sunset", t.UTC().Format(http.TimeFormat))
+		}
+	}
+	if pc.SunsetLink != "" {
+		header.Add("Link", fmt.Sprintf(`<%s>; rel="sunset"`, pc.SunsetLink))
+	}
+}
+
+// RecommendedVersion returns the parsed recommended version, or nil if there
+// is none.
+func (pc *PackageConfig) RecommendedVersion() *semver.Version {
+	if pc.Recommended == "" {
+		return nil
+	}
+	v, err := semver.NewVersion(strings.TrimPrefix(pc.Recommended, "v"))
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// applyFeatures sets the flags controlled by the features cfg enables or
+// disables for env, after applying the default environment. Flags given
+// explicitly on the command line take precedence over features.
+func applyFeatures(fs *flag.FlagSet, cfg *Config, env string) error {
+	envs := []string{defaultEnv}
+	if env != "" && env != defaultEnv {
+		if _, ok := cfg.Features[env]; !ok {
+			return fmt.Errorf("unknown environment %q", env)
+		}
+		envs = append(envs, env)
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for _, name := range envs {
+		features := cfg.Features[name]
+
+		// Apply in a stable order so errors are reproducible.
+		var keys []string
+		for k := range features {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, feature := range keys {
+			flags, ok := featureGroups[feature]
+			if !ok {
+				return fmt.Errorf("unknown feature %q", feature)
+			}
+			for _, f := range flags {
+				if explicit[f.name] {
+					continue
+				}
+				value := f.off
+				if features[feature] {
+					value = f.on
+				}
+				if value == "" {
+					if fl := fs.Lookup(f.name); fl != nil {
+						value = fl.DefValue
+					}
+				}
+				if err := fs.Set(f.name, value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
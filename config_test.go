@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(path, []byte(`{"packages": {"db": {"default_major": 2}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Packages["db"] == nil || cfg.Packages["db"].DefaultMajor != 2 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+
+	err = ioutil.WriteFile(path, []byte(`{"packages": {"db": {"recommended": "v2.x"}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Fatal("accepted an invalid recommended version")
+	}
+}
+
+func TestDefaultMajor(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+		testHash("4")+" refs/tags/v2.0.0",
+		testHash("5")+" refs/tags/v2.0.0^{}",
+		testHash("6")+" refs/tags/v2.1.0",
+		testHash("7")+" refs/tags/v2.1.0^{}",
+		testHash("8")+" refs/tags/v3.0.0",
+		testHash("9")+" refs/tags/v3.0.0^{}",
+	))
+	root.Packages = map[string]*PackageConfig{
+		"db": {DefaultMajor: 2},
+	}
+
+	tests := []struct {
+		summary string
+		path    string
+		vanity  string
+		head    string
+	}{
+		{"Unversioned request uses the default major", "/db", "upper.io/db", testHash("7")},
+		{"Explicit major is unaffected", "/db.v1", "upper.io/db.v1", testHash("3")},
+		{"Other packages are unaffected", "/orm.v3", "upper.io/orm.v3", testHash("9")},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path+"/info/refs?service=git-upload-pack")
+		if resp.Code != 200 {
+			t.Fatalf("%s: unexpected status %d: %s", test.summary, resp.Code, resp.Body)
+		}
+		if head, _ := refsHead(resp.Body.Bytes()); head != test.head {
+			t.Fatalf("%s: HEAD points to %s, want %s", test.summary, head, test.head)
+		}
+
+		resp = serve(root, test.path+"?go-get=1")
+		want := `<meta name="go-import" content="` + test.vanity + ` git https://` + test.vanity + `">`
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Fatalf("%s: missing %s in:\n%s", test.summary, want, resp.Body)
+		}
+	}
+
+	repo := root.NewRepo("db")
+	repo.RequestedVersion.Major = repo.Config.DefaultMajor
+	all, err := versionList("1.0.0", "2.0.0", "2.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.SetVersions(all)
+	if tree := repo.GitTree(); tree != "2.1.0" {
+		t.Fatalf("unexpected tree %q", tree)
+	}
+}
+
+func TestRecommendedVersion(t *testing.T) {
+	defer func(v bool) { *goproxyFlag = v }(*goproxyFlag)
+	*goproxyFlag = true
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v2.0.0^{}",
+		testHash("3")+" refs/tags/v2.1.0^{}",
+		testHash("4")+" refs/tags/v2.2.0^{}",
+	))
+	root.Packages = map[string]*PackageConfig{
+		"db": {Recommended: "v2.1.0"},
+	}
+
+	tests := []struct {
+		summary string
+		path    string
+		head    string
+	}{
+		{"Unversioned request uses the recommended version", "/db", testHash("3")},
+		{"Explicit major is unaffected", "/db.v2", testHash("4")},
+		{"Explicit version is unaffected", "/db.v2.0", testHash("2")},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path+"/info/refs?service=git-upload-pack")
+		if resp.Code != 200 {
+			t.Fatalf("%s: unexpected status %d: %s", test.summary, resp.Code, resp.Body)
+		}
+		if head, _ := refsHead(resp.Body.Bytes()); head != test.head {
+			t.Fatalf("%s: HEAD points to %s, want %s", test.summary, head, test.head)
+		}
+	}
+
+	resp := serve(root, "/db?versions")
+	var info versionsInfo
+	if err := json.Unmarshal(resp.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Selected != "v2.1.0" || len(info.Versions) != 3 {
+		t.Fatalf("unexpected versions info: %+v", info)
+	}
+
+	resp = serve(root, "/proxy/upper.io/db.v2/@v/v2.2.0.info")
+	if want := `{"Version":"v2.2.0","Recommended":"v2.1.0"}`; resp.Body.String() != want {
+		t.Fatalf("got info %s, want %s", resp.Body, want)
+	}
+}
+
+func TestPackageSunset(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+	))
+	root.Packages = map[string]*PackageConfig{
+		"db":  {Sunset: "2027-01-31", SunsetLink: "https://upper.io/migrate"},
+		"orm": {Sunset: "2027-06-30T12:30:00+02:00"},
+	}
+
+	tests := []struct {
+		summary string
+		path    string
+		sunset  string
+		link    string
+	}{
+		{"go get page", "/db.v1?go-get=1", "Sun, 31 Jan 2027 00:00:00 GMT", `<https://upper.io/migrate>; rel="sunset"`},
+		{"Git advertisement", "/db.v1/info/refs?service=git-upload-pack", "Sun, 31 Jan 2027 00:00:00 GMT", `<https://upper.io/migrate>; rel="sunset"`},
+		{"Time without a link", "/orm.v1?go-get=1", "Wed, 30 Jun 2027 10:30:00 GMT", ""},
+		{"Other packages", "/other.v1?go-get=1", "", ""},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path)
+		if resp.Code != 200 {
+			t.Fatalf("%s: unexpected status %d: %s", test.summary, resp.Code, resp.Body)
+		}
+		if got := resp.Header().Get("Sunset"); got != test.sunset {
+			t.Fatalf("%s: got Sunset %q, want %q", test.summary, got, test.sunset)
+		}
+		if got := resp.Header().Get("Link"); got != test.link {
+			t.Fatalf("%s: got Link %q, want %q", test.summary, got, test.link)
+		}
+	}
+
+	if resp := serve(root, "/db.v2?go-get=1"); resp.Header().Get("Sunset") != "" {
+		t.Fatalf("Sunset sent with a failed resolution")
+	}
+
+	if err := checkPackages(map[string]*PackageConfig{"db": {Sunset: "next year"}}); err == nil {
+		t.Fatal("accepted an invalid sunset")
+	}
+}
+
+func TestPackageSourceRoot(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+	))
+	root.Packages = map[string]*PackageConfig{
+		"db": {SourceRoot: "https://git.example.org/upper/db/"},
+	}
+
+	tests := []struct {
+		path   string
+		source string
+	}{
+		{"/db.v1?go-get=1", " _ https://git.example.org/upper/db/tree/"},
+		{"/orm.v1?go-get=1", " _ " + root.repoURL.String() + "/orm/tree/"},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path)
+		if !strings.Contains(resp.Body.String(), test.source) {
+			t.Fatalf("%s: missing %s in:\n%s", test.path, test.source, resp.Body)
+		}
+	}
+}
+
+func TestApplyFeatures(t *testing.T) {
+	cfg := &Config{
+		Features: map[string]map[string]bool{
+			"default":    {"dumb_protocol": true},
+			"staging":    {"goproxy": true},
+			"production": {"goproxy": false, "dumb_protocol": false},
+		},
+	}
+
+	tests := []struct {
+		summary  string
+		env      string
+		args     []string
+		goproxy  bool
+		dumb     bool
+		fallback bool
+	}{
+		{"Default environment", "", nil, false, true, true},
+		{"Environment adds to the default", "staging", nil, true, true, true},
+		{"Environment overrides the default", "production", nil, false, false, false},
+		{"Command line overrides features", "production", []string{"-goproxy", "-dumb-fallback"}, true, false, true},
+	}
+
+	for _, test := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		goproxy := fs.Bool("goproxy", false, "")
+		dumb := fs.Bool("dumb-protocol", false, "")
+		fallback := fs.Bool("dumb-fallback", false, "")
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := applyFeatures(fs, cfg, test.env); err != nil {
+			t.Fatalf("%s: %v", test.summary, err)
+		}
+		if *goproxy != test.goproxy || *dumb != test.dumb || *fallback != test.fallback {
+			t.Fatalf("%s: got goproxy=%v dumb-protocol=%v dumb-fallback=%v", test.summary, *goproxy, *dumb, *fallback)
+		}
+	}
+
+	if err := applyFeatures(flag.NewFlagSet("test", flag.ContinueOnError), cfg, "qa"); err == nil {
+		t.Fatalf("expected an error for an unknown environment")
+	}
+	cfg.Features["qa"] = map[string]bool{"teleport": true}
+	if err := applyFeatures(flag.NewFlagSet("test", flag.ContinueOnError), cfg, "qa"); err == nil {
+		t.Fatalf("expected an error for an unknown feature")
+	}
+}
+
+func TestFeatureGroups(t *testing.T) {
+	tests := []struct {
+		feature string
+		on, off map[string]string
+	}{
+		{"goproxy", map[string]string{"goproxy": "true"}, map[string]string{"goproxy": "false"}},
+		{"dumb_protocol",
+			map[string]string{"dumb-protocol": "true", "dumb-fallback": "true"},
+			map[string]string{"dumb-protocol": "false", "dumb-fallback": "false"}},
+		{"caching", map[string]string{"cache-ttl": "1m0s"}, map[string]string{"cache-ttl": "0s"}},
+		{"metrics", map[string]string{"metrics": "true"}, map[string]string{"metrics": "false"}},
+		{"admin", map[string]string{"history-size": "100"}, map[string]string{"history-size": "0"}},
+		{"debug", map[string]string{"log-level": "debug"}, map[string]string{"log-level": "info"}},
+	}
+	if len(tests) != len(featureGroups) {
+		t.Fatalf("got %d feature groups, want %d", len(featureGroups), len(tests))
+	}
+
+	for _, test := range tests {
+		// Disabling after enabling must restore the defaults, as the
+		// default environment and another one may disagree.
+		cfg := &Config{
+			Features: map[string]map[string]bool{
+				"default":    {test.feature: true},
+				"production": {test.feature: false},
+			},
+		}
+		for env, want := range map[string]map[string]string{"": test.on, "production": test.off} {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.Bool("goproxy", false, "")
+			fs.Bool("dumb-protocol", false, "")
+			fs.Bool("dumb-fallback", false, "")
+			fs.Duration("cache-ttl", time.Minute, "")
+			fs.Bool("metrics", false, "")
+			fs.Int("history-size", 0, "")
+			fs.String("log-level", "info", "")
+			if env == "" {
+				// Start from the disabled values, so that enabling shows.
+				for name, value := range test.off {
+					fs.Lookup(name).Value.Set(value)
+				}
+			}
+
+			if err := applyFeatures(fs, cfg, env); err != nil {
+				t.Fatalf("%s: %v", test.feature, err)
+			}
+			for name, value := range want {
+				if got := fs.Lookup(name).Value.String(); got != value {
+					t.Fatalf("%s in %q: got -%s=%s, want %s", test.feature, env, name, got, value)
+				}
+			}
+		}
+	}
+}
+
+func TestFeaturesToggleEndpoints(t *testing.T) {
+	defer func(v bool) { *goproxyFlag = v }(*goproxyFlag)
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+	))
+	cfg := &Config{
+		Features: map[string]map[string]bool{
+			"staging":    {"goproxy": true},
+			"production": {"goproxy": false},
+		},
+	}
+
+	for _, test := range []struct {
+		env    string
+		status int
+	}{{"staging", 200}, {"production", 404}} {
+		// Share the real flag values, as flags set by a previous call
+		// would count as given on the command line.
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Var(flag.Lookup("goproxy").Value, "goproxy", "")
+
+		if err := applyFeatures(fs, cfg, test.env); err != nil {
+			t.Fatal(err)
+		}
+		if resp := serve(root, "/proxy/upper.io/db/@v/list"); resp.Code != test.status {
+			t.Fatalf("%s: unexpected status %d: %s", test.env, resp.Code, resp.Body)
+		}
+	}
+}
+
+func TestPackageDefaultRef(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/heads/docs",
+		testHash("3")+" refs/tags/v0.1.0",
+		testHash("4")+" refs/tags/v0.1.0^{}",
+		testHash("5")+" refs/tags/v1.0.0",
+		testHash("6")+" refs/tags/v1.0.0^{}",
+	))
+	root.Packages = map[string]*PackageConfig{
+		"db": {DefaultRef: "docs"},
+	}
+
+	tests := []struct {
+		summary string
+		path    string
+		tree    string
+		head    string
+	}{
+		{"Unversioned request points at the default ref", "/db", "docs", testHash("4")},
+		{"Versioned request is unaffected", "/db.v1", "1.0.0", testHash("6")},
+		{"Other packages are unaffected", "/orm", "master", testHash("4")},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path+"?go-get=1")
+		want := "/tree/" + test.tree + "{/dir} "
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Fatalf("%s: missing %s in:\n%s", test.summary, want, resp.Body)
+		}
+		resp = serve(root, test.path+"/info/refs?service=git-upload-pack")
+		if head, _ := refsHead(resp.Body.Bytes()); head != test.head {
+			t.Fatalf("%s: HEAD points to %s, want %s", test.summary, head, test.head)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// versionConstraint is a set of comparisons (e.g.: >=2.3.0 <3.0.0) that a
+// version must all satisfy, as given with ?constraint=.
+type versionConstraint struct {
+	source      string
+	comparisons []versionComparison
+}
+
+// versionComparison compares versions against a fixed one.
+type versionComparison struct {
+	op string
+	v  semver.Version
+}
+
+// constraintOps are the comparison operators, longest first so that ">="
+// is not taken for ">".
+var constraintOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// parseConstraint parses comparisons separated by spaces or commas. Each is
+// an operator followed by a version, with or without a "v" prefix, where a
+// missing minor or patch number is zero (e.g.: <3 is <3.0.0). No operator
+// means "=".
+func parseConstraint(s string) (*versionConstraint, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' })
+	c := &versionConstraint{source: strings.Join(fields, " ")}
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		op := "="
+		for _, o := range constraintOps {
+			if strings.HasPrefix(field, o) {
+				op, field = o, field[len(o):]
+				break
+			}
+		}
+		if field == "" && i+1 < len(fields) {
+			// The operator was followed by a space (e.g.: ">= 2.3.0").
+			i++
+			field = fields[i]
+		}
+		v, err := parsePartialVersion(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version in constraint %q: %v", s, err)
+		}
+		c.comparisons = append(c.comparisons, versionComparison{op, *v})
+	}
+	if len(c.comparisons) == 0 {
+		return nil, fmt.Errorf("empty constraint")
+	}
+	return c, nil
+}
+
+// parsePartialVersion parses a version that may lack the "v" prefix and the
+// minor or patch numbers.
+func parsePartialVersion(s string) (*semver.Version, error) {
+	s, rest := strings.TrimPrefix(s, "v"), ""
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s, rest = s[:i], s[i:]
+	}
+	for n := strings.Count(s, "."); n < 2; n++ {
+		s += ".0"
+	}
+	return semver.NewVersion(s + rest)
+}
+
+// Match reports whether v satisfies every comparison of c.
+func (c *versionConstraint) Match(v *semver.Version) bool {
+	for _, cmp := range c.comparisons {
+		r := v.Compare(cmp.v)
+		var ok bool
+		switch cmp.op {
+		case ">=":
+			ok = r >= 0
+		case "<=":
+			ok = r <= 0
+		case "!=":
+			ok = r != 0
+		case ">":
+			ok = r > 0
+		case "<":
+			ok = r < 0
+		default:
+			ok = r == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the constraint as given, with its comparisons separated by
+// single spaces.
+func (c *versionConstraint) String() string {
+	return c.source
+}
+
+// constraintInfo is the JSON body of constraint responses.
+type constraintInfo struct {
+	Constraint string `json:"constraint"`
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+}
+
+// serveConstraint answers with the version repo resolved to for its
+// constraint, after SetVersions, and the commit it points to.
+func serveConstraint(resp http.ResponseWriter, repo *Repo, commit string) {
+	sendJSON(resp, constraintInfo{
+		Constraint: repo.Constraint.String(),
+		Version:    repo.ResolvedVersionString(),
+		Commit:     commit,
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+func TestParseConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		matches    []string
+		misses     []string
+	}{
+		{">=2.3.0 <3.0.0", []string{"2.3.0", "2.9.1"}, []string{"2.2.9", "3.0.0"}},
+		{">= v2.3, < 3", []string{"2.3.0", "2.9.1"}, []string{"2.2.9", "3.0.0"}},
+		{"1.2.3", []string{"1.2.3"}, []string{"1.2.4"}},
+		{">1 !=1.5.0", []string{"1.0.1", "2.0.0"}, []string{"1.0.0", "1.5.0"}},
+		{"<=1.2.0-rc.1", []string{"1.2.0-beta", "1.1.0"}, []string{"1.2.0"}},
+	}
+
+	for _, test := range tests {
+		c, err := parseConstraint(test.constraint)
+		if err != nil {
+			t.Fatalf("%q: %v", test.constraint, err)
+		}
+		for _, s := range test.matches {
+			if !c.Match(semver.New(s)) {
+				t.Fatalf("%q does not match %s", test.constraint, s)
+			}
+		}
+		for _, s := range test.misses {
+			if c.Match(semver.New(s)) {
+				t.Fatalf("%q matches %s", test.constraint, s)
+			}
+		}
+	}
+
+	for _, s := range []string{"", " , ", ">=", ">=x", "~1.2.0", "1.2.3.4"} {
+		if _, err := parseConstraint(s); err == nil {
+			t.Fatalf("accepted constraint %q", s)
+		}
+	}
+}
+
+func TestConstraintResolution(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.9.0^{}",
+		testHash("3")+" refs/tags/v2.2.0^{}",
+		testHash("4")+" refs/tags/v2.3.0^{}",
+		testHash("5")+" refs/tags/v2.4.1^{}",
+		testHash("6")+" refs/tags/v2.5.0-rc1^{}",
+		testHash("7")+" refs/tags/v3.0.0^{}",
+		testHash("8")+" refs/heads/v4",
+	))
+
+	tests := []struct {
+		summary    string
+		path       string
+		constraint string
+		version    string
+		commit     string
+	}{
+		{"Range", "/db", ">=2.3.0 <3.0.0", "v2.4.1", testHash("5")},
+		{"Range across majors", "/db", ">=1.0.0", "v3.0.0", testHash("7")},
+		{"Range within a major", "/db.v2", "<2.4.0", "v2.3.0", testHash("4")},
+		{"Exact version", "/db", "=2.2.0", "v2.2.0", testHash("3")},
+		{"Empty match", "/db", ">=2.5.0 <3.0.0", "", ""},
+		{"Empty match within a major", "/db.v3", "<3.0.0", "", ""},
+		{"Branches do not match", "/db", ">=4", "", ""},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path+"?constraint="+url.QueryEscape(test.constraint))
+		if test.version == "" {
+			if resp.Code != 404 {
+				t.Fatalf("%s: got status %d, want 404: %s", test.summary, resp.Code, resp.Body)
+			}
+			continue
+		}
+		if resp.Code != 200 {
+			t.Fatalf("%s: unexpected status %d: %s", test.summary, resp.Code, resp.Body)
+		}
+		var info constraintInfo
+		if err := json.Unmarshal(resp.Body.Bytes(), &info); err != nil {
+			t.Fatalf("%s: %v", test.summary, err)
+		}
+		if info.Version != test.version || info.Commit != test.commit {
+			t.Fatalf("%s: got %s at %s, want %s at %s", test.summary, info.Version, info.Commit, test.version, test.commit)
+		}
+	}
+
+	if resp := serve(root, "/db?constraint=%3E%3Dnope"); resp.Code != 400 {
+		t.Fatalf("got status %d for an invalid constraint, want 400", resp.Code)
+	}
+}
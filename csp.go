@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// pageData is what HTML page templates are executed with.
+type pageData struct {
+	*Repo
+
+	// Nonce authorizes inline scripts under the Content-Security-Policy,
+	// or is empty if -csp is not set.
+	Nonce string
+
+	// Script is inlined into the page, if set. It comes from the operator
+	// (-page-script), so it is trusted and not escaped.
+	Script template.JS
+}
+
+// newNonce returns a random nonce for a Content-Security-Policy, in the URL
+// alphabet of base64 so that it needs no escaping in HTML attributes.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// newPageData prepares the data for rendering an HTML page about repo,
+// sending a Content-Security-Policy header with a fresh nonce if -csp is set.
+func newPageData(resp http.ResponseWriter, repo *Repo) (*pageData, error) {
+	data := &pageData{Repo: repo, Script: template.JS(pageScript)}
+	if !*cspFlag {
+		return data, nil
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	data.Nonce = nonce
+	resp.Header().Set("Content-Security-Policy", fmt.Sprintf("default-src 'none'; script-src 'nonce-%s'", nonce))
+	return data, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCSPNonce(t *testing.T) {
+	defer func(v bool) { *cspFlag = v }(*cspFlag)
+	*cspFlag = true
+
+	defer func(s string) { pageScript = s }(pageScript)
+	pageScript = "console.log(1)"
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+	))
+
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		resp := serve(root, "/db.v1?go-get=1")
+		if resp.Code != 200 {
+			t.Fatalf("unexpected status %d: %s", resp.Code, resp.Body)
+		}
+
+		csp := resp.Header().Get("Content-Security-Policy")
+		i := strings.Index(csp, "'nonce-")
+		if i < 0 {
+			t.Fatalf("missing nonce in policy %q", csp)
+		}
+		nonce := csp[i+7:]
+		nonce = nonce[:strings.IndexByte(nonce, '\'')]
+
+		if seen[nonce] {
+			t.Fatalf("nonce %s was reused", nonce)
+		}
+		seen[nonce] = true
+
+		want := `<script nonce="` + nonce + `">console.log(1)</script>`
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Fatalf("missing %s in:\n%s", want, resp.Body)
+		}
+	}
+
+	if resp := serve(root, "/db.v1/info/refs?service=git-upload-pack"); resp.Header().Get("Content-Security-Policy") != "" {
+		t.Fatalf("unexpected policy on the git advertisement")
+	}
+
+	*cspFlag = false
+	resp := serve(root, "/db.v1?go-get=1")
+	if resp.Header().Get("Content-Security-Policy") != "" || !strings.Contains(resp.Body.String(), "<script>console.log(1)</script>") {
+		t.Fatalf("unexpected page without -csp:\n%s", resp.Body)
+	}
+}
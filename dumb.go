@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const smartContentType = "application/x-git-upload-pack-advertisement"
+
+// isSmartResponse reports whether resp carries a smart protocol refs
+// advertisement.
+func isSmartResponse(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), smartContentType)
+}
+
+// fetchDumbHead fetches the HEAD file of a repository served with the dumb
+// protocol.
+func fetchDumbHead(repo *Repo) ([]byte, error) {
+	resp, err := httpClient.Get(repo.RepoRootURL() + ".git/HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("cannot talk to git repository: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("error fetching HEAD from git repository: %v", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// dumbToSmart converts a dumb protocol refs listing into a smart protocol
+// advertisement, adding the HEAD line that dumb listings lack. The head
+// argument holds the contents of the repository's HEAD file.
+func dumbToSmart(data []byte, head []byte) ([]byte, error) {
+	type ref struct{ hash, name string }
+
+	var refs []ref
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 || len(fields[0]) != 40 {
+			return nil, fmt.Errorf("cannot parse dumb refs line: %q", line)
+		}
+		refs = append(refs, ref{fields[0], fields[1]})
+	}
+
+	headHash := strings.TrimSpace(string(head))
+	if strings.HasPrefix(headHash, "ref: ") {
+		target := strings.TrimPrefix(headHash, "ref: ")
+		headHash = ""
+		for _, r := range refs {
+			if r.name == target {
+				headHash = r.hash
+				break
+			}
+		}
+	}
+	if len(headHash) != 40 {
+		return nil, ErrNoVersion
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("001e# service=git-upload-pack\n0000")
+	writePktLine(&buf, headHash+" HEAD\n")
+	for _, r := range refs {
+		writePktLine(&buf, r.hash+" "+r.name+"\n")
+	}
+	buf.WriteString("0000")
+	return buf.Bytes(), nil
+}
+
+// smartToDumb converts a smart protocol advertisement back into a dumb
+// protocol refs listing.
+func smartToDumb(data []byte) ([]byte, error) {
+	lines, err := pktLines(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if len(line) < 42 || line[0] == '#' || line[40] != ' ' {
+			continue
+		}
+		name := line[41:]
+		if i := strings.IndexAny(name, "\n\x00"); i >= 0 {
+			name = name[:i]
+		}
+		if name == "HEAD" {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", line[:40], name)
+	}
+	return buf.Bytes(), nil
+}
+
+// serveDumb answers the requests a git client sends to a repository served
+// with the dumb protocol. HEAD always points to master, which changeRefs
+// already rewrote to the selected version.
+func serveDumb(resp http.ResponseWriter, req *http.Request, repo *Repo, extra string, changed []byte) {
+	switch {
+	case extra == "/info/refs":
+		refs, err := smartToDumb(changed)
+		if err != nil {
+			sendError(resp, "Failed to convert refs: %v", err)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/plain")
+		writeBody(resp, http.StatusOK, refs)
+	case extra == "/HEAD":
+		resp.Header().Set("Content-Type", "text/plain")
+		writeBody(resp, http.StatusOK, []byte("ref: refs/heads/master\n"))
+	case strings.HasPrefix(extra, "/objects/"):
+		proxyRes, err := httpClient.Get(repo.RepoRootURL() + ".git" + extra)
+		if err != nil {
+			repo.Log().Error(fmt.Sprintf("Proxy: %v", err))
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer proxyRes.Body.Close()
+
+		if ct := proxyRes.Header.Get("Content-Type"); ct != "" {
+			resp.Header().Set("Content-Type", ct)
+		}
+		resp.WriteHeader(proxyRes.StatusCode)
+		if _, err := io.Copy(resp, proxyRes.Body); err != nil {
+			repo.Log().Error(fmt.Sprintf("Proxy: %v", err))
+		}
+	default:
+		sendNotFound(resp, "Git repository at https://%s only supports the dumb HTTP protocol", repo.RepoRoot())
+	}
+}
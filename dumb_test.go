@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumbProtocol(t *testing.T) {
+	defer func(v bool) { *dumbProtocolFlag = v }(*dumbProtocolFlag)
+	*dumbProtocolFlag = true
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		switch r.URL.Path {
+		case "/db.git/info/refs":
+			io.WriteString(w, strings.Join([]string{
+				testHash("1") + "\trefs/heads/master",
+				testHash("2") + "\trefs/tags/v1.0.0",
+				testHash("3") + "\trefs/tags/v1.0.0^{}",
+				testHash("4") + "\trefs/tags/v1.1.0",
+				testHash("5") + "\trefs/tags/v1.1.0^{}",
+			}, "\n")+"\n")
+		case "/db.git/HEAD":
+			io.WriteString(w, "ref: refs/heads/master\n")
+		case "/db.git/objects/info/packs":
+			io.WriteString(w, "P pack-1.pack\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	root, err := NewRepoRoot(srv.URL, "https://upper.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := serve(root, "/db.v1?go-get=1")
+	if resp.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", resp.Code, resp.Body)
+	}
+	if !strings.Contains(resp.Body.String(), `<meta name="go-import" content="upper.io/db.v1 git https://upper.io/db.v1">`) {
+		t.Fatalf("missing go-import meta in:\n%s", resp.Body)
+	}
+
+	resp = serve(root, "/db.v1/mongo?go-get=1")
+	if resp.Code != 200 {
+		t.Fatalf("subpackage: unexpected status %d: %s", resp.Code, resp.Body)
+	}
+	if !strings.Contains(resp.Body.String(), `<meta name="go-import" content="upper.io/db.v1 git https://upper.io/db.v1">`) {
+		t.Fatalf("subpackage: missing go-import meta in:\n%s", resp.Body)
+	}
+
+	resp = serve(root, "/db.v1/info/refs?service=git-upload-pack")
+	if ct := resp.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	want := strings.Join([]string{
+		testHash("5") + "\trefs/heads/master",
+		testHash("2") + "\trefs/tags/v1.0.0",
+		testHash("3") + "\trefs/tags/v1.0.0^{}",
+		testHash("4") + "\trefs/tags/v1.1.0",
+		testHash("5") + "\trefs/tags/v1.1.0^{}",
+	}, "\n") + "\n"
+	if got := resp.Body.String(); got != want {
+		t.Fatalf("got refs:\n%s\nwant:\n%s", got, want)
+	}
+
+	resp = serve(root, "/db.v1/HEAD")
+	if got := resp.Body.String(); got != "ref: refs/heads/master\n" {
+		t.Fatalf("unexpected HEAD %q", got)
+	}
+
+	resp = serve(root, "/db.v1/objects/info/packs")
+	if got := resp.Body.String(); got != "P pack-1.pack\n" {
+		t.Fatalf("unexpected packs %q", got)
+	}
+
+	// Objects are streamed as they come, so they neither are compressed nor
+	// vary by Accept-Encoding.
+	defer func(e []string) { encodings = e }(encodings)
+	defer func(n int) { *compressMinSizeFlag = n }(*compressMinSizeFlag)
+	encodings, *compressMinSizeFlag = []string{"gzip"}, 0
+	resp = serveEncoded(root, "/db.v1/objects/info/packs", "gzip")
+	if got := resp.Body.String(); got != "P pack-1.pack\n" {
+		t.Fatalf("unexpected packs %q", got)
+	}
+	if vary := resp.Header().Get("Vary"); vary != "" {
+		t.Fatalf("got Vary %q for streamed objects", vary)
+	}
+}
+
+func TestDumbFallbackOnTimeout(t *testing.T) {
+	defer func(v bool) { *dumbFallbackFlag = v }(*dumbFallbackFlag)
+	*dumbFallbackFlag = true
+
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = &http.Client{Timeout: 50 * time.Millisecond}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/db.git/info/refs" && r.URL.Query().Get("service") != "":
+			time.Sleep(200 * time.Millisecond)
+			w.Header().Set("Content-Type", smartContentType)
+		case r.URL.Path == "/db.git/info/refs":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, testHash("1")+"\trefs/heads/master\n"+
+				testHash("2")+"\trefs/tags/v1.0.0\n"+
+				testHash("3")+"\trefs/tags/v1.0.0^{}\n")
+		case r.URL.Path == "/db.git/HEAD":
+			io.WriteString(w, "ref: refs/heads/master\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	root, err := NewRepoRoot(srv.URL, "https://upper.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := serve(root, "/db.v1/info/refs?service=git-upload-pack")
+	if resp.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", resp.Code, resp.Body)
+	}
+	want := testHash("3") + "\trefs/heads/master\n" +
+		testHash("2") + "\trefs/tags/v1.0.0\n" +
+		testHash("3") + "\trefs/tags/v1.0.0^{}\n"
+	if got := resp.Body.String(); got != want {
+		t.Fatalf("got refs:\n%s\nwant:\n%s", got, want)
+	}
+
+	*dumbFallbackFlag = false
+	if resp := serve(root, "/db.v1?go-get=1"); resp.Code != http.StatusBadGateway {
+		t.Fatalf("unexpected status without fallback %d: %s", resp.Code, resp.Body)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEdgeChannel(t *testing.T) {
+	refs := reflines(
+		testHash("1")+" HEAD\x00multi_ack symref=HEAD:refs/heads/main",
+		testHash("1")+" refs/heads/main",
+		testHash("2")+" refs/tags/v1.0.0",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+	)
+	root := fakeUpstream(t, refs)
+
+	for _, target := range []string{"/db.edge?go-get=1", "/db?channel=edge&go-get=1"} {
+		resp := serve(root, target)
+		if resp.Code != 200 {
+			t.Fatalf("%s: unexpected status %d: %s", target, resp.Code, resp.Body)
+		}
+		body := resp.Body.String()
+		if !strings.Contains(body, `<meta name="go-import" content="upper.io/db git https://upper.io/db.edge">`) {
+			t.Fatalf("%s: missing go-import meta in:\n%s", target, body)
+		}
+		if !strings.Contains(body, "/db/tree/main{/dir}") {
+			t.Fatalf("%s: go-source does not point at the default branch:\n%s", target, body)
+		}
+	}
+
+	resp := serve(root, "/db.edge/info/refs?service=git-upload-pack")
+	if got := resp.Body.String(); got != refs {
+		t.Fatalf("edge advertisement was rewritten:\n%q\nwant:\n%q", got, refs)
+	}
+	if hash, branch := refsHead(resp.Body.Bytes()); hash != testHash("1") || branch != "main" {
+		t.Fatalf("unexpected HEAD %s %s", hash, branch)
+	}
+
+	for _, target := range []string{"/db.v1?channel=edge&go-get=1", "/db?channel=nightly&go-get=1"} {
+		if resp := serve(root, target); resp.Code != 404 {
+			t.Fatalf("%s: unexpected status %d", target, resp.Code)
+		}
+	}
+}
@@ -1,8 +1,26 @@
 module github.com/xiam/vanity
 
-go 1.17
+go 1.22
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/coreos/go-semver v0.3.1
-	gopkg.in/check.v1 v1.0.0-20150729080431-11d3bc7aa68e
+	github.com/prometheus/client_golang v1.19.1
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.35.0
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	github.com/rogpeppe/go-internal v1.10.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
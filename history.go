@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// historyPath is where the resolution history is served when -history-size
+// is set. Package names cannot contain "_", so it never shadows a package.
+const historyPath = "/_/admin/history"
+
+// maxHistoryPackages bounds the packages the history keeps track of, as
+// requests choose them. The package requested least recently goes first.
+const maxHistoryPackages = 1024
+
+// historyEntry describes a change in the version a package resolves to.
+type historyEntry struct {
+	Time   time.Time `json:"time"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Commit string    `json:"commit"`
+}
+
+// resolutionHistory keeps the latest changes in the version each package
+// resolves to, by package path (e.g.: upper.io/db.v4).
+type resolutionHistory struct {
+	mu      sync.Mutex
+	size    int
+	last    map[string]lastResolution
+	changes map[string][]historyEntry
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// lastResolution is the version a package last resolved to, and when.
+type lastResolution struct {
+	version string
+	at      time.Time
+}
+
+// history records resolution changes when -history-size is set.
+var history *resolutionHistory
+
+// newResolutionHistory creates a history that keeps up to size changes per
+// package.
+func newResolutionHistory(size int) *resolutionHistory {
+	return &resolutionHistory{
+		size:    size,
+		last:    make(map[string]lastResolution),
+		changes: make(map[string][]historyEntry),
+		now:     time.Now,
+	}
+}
+
+// Record notes that pkg resolved to version at commit, adding an entry if
+// it resolved to a different version before. A nil resolutionHistory records
+// nothing.
+func (h *resolutionHistory) Record(pkg, version, commit string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now().UTC()
+	last, seen := h.last[pkg]
+	if !seen && len(h.last) >= maxHistoryPackages {
+		h.evict()
+	}
+	h.last[pkg] = lastResolution{version, now}
+	if !seen || last.version == version {
+		return
+	}
+
+	changes := append(h.changes[pkg], historyEntry{
+		Time:   now,
+		From:   last.version,
+		To:     version,
+		Commit: commit,
+	})
+	if len(changes) > h.size {
+		changes = changes[len(changes)-h.size:]
+	}
+	h.changes[pkg] = changes
+}
+
+// evict forgets the package requested least recently.
+func (h *resolutionHistory) evict() {
+	var oldest string
+	for pkg, last := range h.last {
+		if oldest == "" || last.at.Before(h.last[oldest].at) {
+			oldest = pkg
+		}
+	}
+	delete(h.last, oldest)
+	delete(h.changes, oldest)
+}
+
+// Changes returns the changes recorded for pkg, oldest first, or for every
+// package if pkg is empty.
+func (h *resolutionHistory) Changes(pkg string) map[string][]historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make(map[string][]historyEntry)
+	for name, changes := range h.changes {
+		if pkg == "" || pkg == name {
+			result[name] = append([]historyEntry(nil), changes...)
+		}
+	}
+	return result
+}
+
+// serveHistory answers with the resolution history, of the package given in
+// the package query parameter or of all of them. Requests must carry
+// -admin-token as a bearer token, and are refused if it is not set.
+func serveHistory(resp http.ResponseWriter, req *http.Request) {
+	if *adminTokenFlag == "" {
+		writeBody(resp, http.StatusUnauthorized, []byte("No admin token is set."))
+		return
+	}
+	token := req.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(token), []byte("Bearer "+*adminTokenFlag)) != 1 {
+		writeBody(resp, http.StatusUnauthorized, []byte("Missing or wrong admin token."))
+		return
+	}
+
+	changes := history.Changes(req.FormValue("package"))
+	type packageHistory struct {
+		Package string         `json:"package"`
+		Changes []historyEntry `json:"changes"`
+	}
+	list := []packageHistory{}
+	for pkg, c := range changes {
+		list = append(list, packageHistory{pkg, c})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Package < list[j].Package })
+	sendJSON(resp, list)
+}
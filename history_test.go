@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolutionHistory(t *testing.T) {
+	h := newResolutionHistory(2)
+	h.now = func() time.Time { return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	h.Record("upper.io/db.v1", "v1.0.0", testHash("1"))
+	h.Record("upper.io/db.v1", "v1.0.0", testHash("1"))
+	if changes := h.Changes(""); len(changes) != 0 {
+		t.Fatalf("got changes %v without a version change", changes)
+	}
+
+	h.Record("upper.io/db.v1", "v1.1.0", testHash("2"))
+	h.Record("upper.io/db.v1", "v1.2.0", testHash("3"))
+	h.Record("upper.io/db.v1", "v1.1.0", testHash("2"))
+	h.Record("upper.io/db.v2", "v2.0.0", testHash("4"))
+
+	changes := h.Changes("upper.io/db.v1")["upper.io/db.v1"]
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes, want the last 2", len(changes))
+	}
+	if c := changes[0]; c.From != "v1.1.0" || c.To != "v1.2.0" || c.Commit != testHash("3") {
+		t.Fatalf("unexpected oldest change %+v", c)
+	}
+	if c := changes[1]; c.From != "v1.2.0" || c.To != "v1.1.0" {
+		t.Fatalf("unexpected latest change %+v", c)
+	}
+
+	// Past the limit, the package requested least recently is forgotten.
+	for i := 0; i < maxHistoryPackages; i++ {
+		h.now = func() time.Time { return time.Date(2020, 1, 2, 0, 0, i, 0, time.UTC) }
+		h.Record(fmt.Sprintf("upper.io/pkg%d", i), "v1.0.0", testHash("1"))
+	}
+	if len(h.last) != maxHistoryPackages {
+		t.Fatalf("got %d packages, want %d", len(h.last), maxHistoryPackages)
+	}
+	if _, ok := h.Changes("upper.io/db.v1")["upper.io/db.v1"]; ok {
+		t.Fatalf("kept the changes of the package requested least recently")
+	}
+}
+
+func TestHistoryEndpoint(t *testing.T) {
+	defer func(s string) { *adminTokenFlag = s }(*adminTokenFlag)
+	defer func() { history, cache = nil, nil }()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache = newRefsCache(time.Minute, 0)
+	cache.now = func() time.Time { return now }
+	history = newResolutionHistory(10)
+	history.now = cache.now
+
+	var mu sync.Mutex
+	refs := reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", smartContentType)
+		io.WriteString(w, refs)
+	}))
+	defer srv.Close()
+
+	root, err := NewRepoRoot(srv.URL, "https://upper.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve(root, "/db.v1?go-get=1")
+
+	// A new release only shows up once the cached refs expire.
+	mu.Lock()
+	refs = reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+		testHash("3")+" refs/tags/v1.1.0^{}",
+	)
+	mu.Unlock()
+	serve(root, "/db.v1?go-get=1")
+	now = now.Add(time.Minute)
+	serve(root, "/db.v1?go-get=1")
+
+	// Other spellings of the version count as the same package, and pinned
+	// versions are not recorded.
+	for _, path := range []string{"/db.v01?go-get=1", "/db.v1.0?go-get=1", "/db.v1.0.0?go-get=1"} {
+		serve(root, path)
+	}
+	if len(history.last) != 1 {
+		t.Fatalf("got %d packages recorded, want 1: %v", len(history.last), history.last)
+	}
+
+	*adminTokenFlag = ""
+	if resp := serve(root, historyPath); resp.Code != http.StatusUnauthorized || strings.Contains(resp.Body.String(), "upper.io") {
+		t.Fatalf("got status %d with no admin token set: %s", resp.Code, resp.Body)
+	}
+
+	*adminTokenFlag = "secret"
+	if resp := serve(root, historyPath); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d without the admin token", resp.Code)
+	}
+
+	req := httptest.NewRequest("GET", historyPath+"?package=upper.io/db.v1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	newHandler(root)(resp, req)
+	if resp.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", resp.Code, resp.Body)
+	}
+
+	var list []struct {
+		Package string
+		Changes []historyEntry
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Package != "upper.io/db.v1" || len(list[0].Changes) != 1 {
+		t.Fatalf("unexpected history %s", resp.Body)
+	}
+	c := list[0].Changes[0]
+	if c.From != "v1.0.0" || c.To != "v1.1.0" || c.Commit != testHash("3") || !c.Time.Equal(now) {
+		t.Fatalf("unexpected change %+v", c)
+	}
+}
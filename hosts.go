@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hostPolicy decides which public host a request was sent to, trusting the
+// X-Forwarded-Host header only when it comes from a known proxy.
+type hostPolicy struct {
+	proxies []*net.IPNet
+	allowed []string
+}
+
+// newHostPolicy creates a hostPolicy from comma-separated lists of trusted
+// proxy addresses (IPs or CIDRs) and allowed hosts. Allowed hosts may start
+// with "*." to match any subdomain.
+func newHostPolicy(proxies, allowed string) (*hostPolicy, error) {
+	var err error
+	p := &hostPolicy{}
+	if p.proxies, err = parseProxies(proxies); err != nil {
+		return nil, err
+	}
+	for _, s := range splitList(allowed) {
+		p.allowed = append(p.allowed, strings.ToLower(s))
+	}
+	return p, nil
+}
+
+// Host returns the public host req was sent to, or an empty string if it
+// cannot be determined or is not allowed. A nil hostPolicy returns an empty
+// string.
+func (p *hostPolicy) Host(req *http.Request) string {
+	if p == nil {
+		return ""
+	}
+	host := req.Host
+	if fwd := req.Header.Get("X-Forwarded-Host"); fwd != "" && p.trusted(req) {
+		host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	host = strings.ToLower(host)
+	if !p.allows(host) {
+		return ""
+	}
+	return host
+}
+
+func (p *hostPolicy) trusted(req *http.Request) bool {
+	return isProxy(p.proxies, net.ParseIP(peerIP(req)))
+}
+
+// trustedProxies are the proxies from -trusted-proxies, whose X-Forwarded-For
+// and X-Real-IP headers give the address of the client.
+var trustedProxies []*net.IPNet
+
+// parseProxies parses a comma-separated list of proxy addresses (IPs or
+// CIDRs).
+func parseProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, s := range splitList(s) {
+		cidr := s
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy address %q", s)
+		}
+		proxies = append(proxies, ipnet)
+	}
+	return proxies, nil
+}
+
+// isProxy reports whether ip is one of proxies.
+func isProxy(proxies []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range proxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent req, without a port.
+// Requests from trusted proxies, and over -socket, where the peer has no
+// address and can only be a local proxy, are from the client the proxies
+// forwarded them for: the last address of X-Forwarded-For that is not a
+// trusted proxy, or else X-Real-IP.
+func clientIP(req *http.Request) string {
+	peer := peerIP(req)
+	if ip := net.ParseIP(peer); ip != nil && !isProxy(trustedProxies, ip) {
+		return peer
+	}
+	forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		if !isProxy(trustedProxies, ip) {
+			return ip.String()
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
+
+// peerIP returns the address req came from, without a port.
+func peerIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (p *hostPolicy) allows(host string) bool {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	for _, pattern := range p.allowed {
+		if pattern == host || pattern == name {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(name, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma-separated list, dropping empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForwardedHost(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+	))
+
+	defer func() { vanityHosts = nil }()
+
+	var err error
+	vanityHosts, err = newHostPolicy("192.0.2.0/24, 2001:db8::1", "go.example.org,*.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		summary    string
+		remoteAddr string
+		host       string
+		forwarded  string
+		vanity     string
+	}{
+		{"Trusted proxy and allowed host", "192.0.2.10:1234", "internal:8080", "go.example.org", "go.example.org"},
+		{"Trusted IPv6 proxy", "[2001:db8::1]:1234", "internal:8080", "go.example.org", "go.example.org"},
+		{"First forwarded host wins", "192.0.2.10:1234", "internal:8080", "pkg.example.net, internal", "pkg.example.net"},
+		{"Untrusted proxy", "198.51.100.1:1234", "internal:8080", "go.example.org", "upper.io"},
+		{"Trusted proxy and unknown host", "192.0.2.10:1234", "internal:8080", "evil.example.com", "upper.io"},
+		{"Allowed Host header", "198.51.100.1:1234", "go.example.org", "", "go.example.org"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/db.v1?go-get=1", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Host = test.host
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-Host", test.forwarded)
+		}
+		resp := httptest.NewRecorder()
+		newHandler(root)(resp, req)
+
+		want := `<meta name="go-import" content="` + test.vanity + `/db.v1 git https://` + test.vanity + `/db.v1">`
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Fatalf("%s: missing %s in:\n%s", test.summary, want, resp.Body)
+		}
+	}
+
+	if root.VanityHostPath != "upper.io" {
+		t.Fatalf("shared repo root was modified: %s", root.VanityHostPath)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(p []*net.IPNet) { trustedProxies = p }(trustedProxies)
+	var err error
+	if trustedProxies, err = parseProxies("192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		summary    string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{"Direct client", "198.51.100.1:1234", "203.0.113.9", "203.0.113.9", "198.51.100.1"},
+		{"Trusted proxy", "192.0.2.10:1234", "203.0.113.9", "", "203.0.113.9"},
+		{"Trusted proxies are skipped", "192.0.2.10:1234", "203.0.113.9, 198.51.100.7, 192.0.2.11", "", "198.51.100.7"},
+		{"Trusted proxy with X-Real-IP", "192.0.2.10:1234", "", "203.0.113.9", "203.0.113.9"},
+		{"Trusted proxy without headers", "192.0.2.10:1234", "", "", "192.0.2.10"},
+		{"Unix socket", "@", "203.0.113.9", "", "203.0.113.9"},
+		{"Unix socket with X-Real-IP", "", "", "203.0.113.9", "203.0.113.9"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/db.v1?go-get=1", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			req.Header.Set("X-Real-IP", test.realIP)
+		}
+		if got := clientIP(req); got != test.want {
+			t.Fatalf("%s: got %q, want %q", test.summary, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+var (
+	logFormatFlag = flag.String("log-format", "text", "Log format: text, as plain lines, or json")
+	logLevelFlag  = flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+)
+
+// logger is where log lines go, as set up from -log-format and -log-level.
+var logger = slog.Default()
+
+// newLogger returns a logger writing to w in the given format from the given
+// level on. The text format keeps the plain lines of the standard log
+// package, with the attributes appended, and writes to its output instead of
+// w.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("-log-level must be debug, info, warn or error")
+	}
+	switch format {
+	case "text":
+		slog.SetLogLoggerLevel(lvl)
+		return slog.Default(), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: lvl})), nil
+	}
+	return nil, fmt.Errorf("-log-format must be text or json")
+}
+
+// logKey is the context key of the logger of a request.
+type logKey struct{}
+
+// withRequestLogger returns req with a logger that tags its lines with id.
+func withRequestLogger(req *http.Request, id string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), logKey{}, logger.With("request_id", id)))
+}
+
+// requestLogger returns the logger of req, or logger if it has none.
+func requestLogger(req *http.Request) *slog.Logger {
+	if l, ok := req.Context().Value(logKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// newRequestID returns a random ID that correlates the log lines of a
+// request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "-"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogging(t *testing.T) {
+	defer func(l *slog.Logger) { logger = l }(logger)
+
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "json", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger = l
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+	))
+	resp := serve(root, "/db.v1?go-get=1")
+	id := resp.Header().Get("X-Request-ID")
+	if id == "" {
+		t.Fatal("missing X-Request-ID header")
+	}
+
+	var request, fetch map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		if entry["request_id"] != id {
+			t.Fatalf("log line without request ID %s: %s", id, line)
+		}
+		switch msg, _ := entry["msg"].(string); {
+		case strings.Contains(msg, " requested "):
+			request = entry
+		case strings.HasPrefix(msg, "Fetched refs"):
+			fetch = entry
+		}
+	}
+	if request == nil || fetch == nil {
+		t.Fatalf("missing request or fetch log line in:\n%s", buf.String())
+	}
+	for key, want := range map[string]interface{}{
+		"level":   "INFO",
+		"method":  "GET",
+		"path":    "/db.v1",
+		"outcome": outcomeOK,
+	} {
+		if request[key] != want {
+			t.Fatalf("got %s %v, want %v in %v", key, request[key], want, request)
+		}
+	}
+	if fetch["level"] != "DEBUG" {
+		t.Fatalf("unexpected fetch log line %v", fetch)
+	}
+
+	buf.Reset()
+	if logger, err = newLogger(&buf, "json", "warn"); err != nil {
+		t.Fatal(err)
+	}
+	serve(root, "/db.v1?go-get=1")
+	if buf.Len() != 0 {
+		t.Fatalf("got log lines below -log-level:\n%s", buf.String())
+	}
+}
+
+func TestNewLoggerFlags(t *testing.T) {
+	for _, test := range []struct{ format, level string }{
+		{"xml", "info"},
+		{"json", "verbose"},
+	} {
+		if _, err := newLogger(&bytes.Buffer{}, test.format, test.level); err == nil {
+			t.Fatalf("accepted -log-format %q and -log-level %q", test.format, test.level)
+		}
+	}
+}
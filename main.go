@@ -5,37 +5,121 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/coreos/go-semver/semver"
+	"golang.org/x/net/netutil"
 )
 
 var (
-	addrFlag       = flag.String("addr", ":8080", "Serve HTTP at given address")
-	socketFlag     = flag.String("socket", "", "Serve HTTP at given UNIX socket")
-	vanityRootFlag = flag.String("vanity-root", "", "Vanity root URL (e.g.: https://upper.io).")
-	repoRootFlag   = flag.String("repo-root", "", "Git repository root URL (e.g.: https://github.com/upper).")
+	addrFlag        = flag.String("addr", ":8080", "Serve HTTP at given address")
+	socketFlag      = flag.String("socket", "", "Serve HTTP at given UNIX socket")
+	tlsDomainsFlag  = flag.String("tls-domains", "", "Comma-separated domains to serve HTTPS for with Let's Encrypt certificates, redirecting -addr to HTTPS")
+	tlsAddrFlag     = flag.String("tls-addr", ":443", "Serve HTTPS at given address when -tls-domains is set")
+	tlsCacheDirFlag = flag.String("tls-cache-dir", "", "Directory to keep Let's Encrypt certificates in when -tls-domains is set")
+	maxConnsFlag    = flag.Int("max-conns", 0, "Maximum number of simultaneous connections (0 means no limit)")
+	vanityRootFlag  = flag.String("vanity-root", "", "Vanity root URL (e.g.: https://upper.io).")
+	repoRootFlag    = flag.String("repo-root", "", "Git repository root URL (e.g.: https://github.com/upper).")
+	moduleStyleFlag = flag.String("module-style", gopkgStyle, "Import path style of versioned packages: gopkg (pkg.vN) or modules (pkg/vN from v2 on)")
+	configFlag      = flag.String("config", "", "JSON configuration file with per-package settings and features")
+	envFlag         = flag.String("env", "", "Environment whose features are enabled from -config (e.g.: staging)")
+
+	listPackagesFlag   = flag.Bool("list-packages", false, "List the packages from -config as JSON at /_/packages, except hidden ones")
+	docsURLFlag        = flag.String("docs-url", "", "URL template (e.g.: https://pkg.go.dev/{vanity}) browsers are redirected to instead of getting a 404")
+	sourceTemplateFlag = flag.String("source-template", "github", "Layout of source links: github, gitlab, gitea, or directory and file URL patterns separated by a space")
+	robotsTagFlag      = flag.String("robots-tag", "", "X-Robots-Tag header (e.g.: noindex) sent with the HTML pages of packages")
+
+	allowedHostsFlag   = flag.String("allowed-hosts", "", "Comma-separated public hosts (e.g.: upper.io,*.upper.io) that replace the -vanity-root host when requested")
+	trustedProxiesFlag = flag.String("trusted-proxies", "", "Comma-separated proxy addresses or CIDRs whose X-Forwarded-Host, X-Forwarded-For and X-Real-IP headers are trusted")
+
+	goproxyFlag      = flag.Bool("goproxy", false, "Serve the GOPROXY protocol under /proxy/")
+	rawURLFlag       = flag.String("raw-url", "{repo}/raw/{ref}/{file}", "URL template for raw files in a repository, used by -goproxy")
+	archiveURLFlag   = flag.String("archive-url", "{repo}/archive/{ref}.tar.gz", "URL template for the tar.gz archive of a repository at a commit, used by -goproxy for module zips")
+	incompatibleFlag = flag.Bool("incompatible", false, "List v2+ versions without a go.mod as +incompatible versions of the unversioned module in -goproxy")
+
+	ssoStatusFlag = flag.Int("sso-status", http.StatusBadGateway, "HTTP status (502 or 403) sent when a repository requires SSO authorization")
+
+	allowLightweightTagsFlag = flag.Bool("allow-lightweight-tags", false, "Accept lightweight (non-annotated) version tags")
+	includePrereleasesFlag   = flag.Bool("include-prereleases", false, "Let pre-release tags (e.g.: v4.0.0-rc1) be selected as the version of a package")
+
+	cacheTTLFlag         = flag.Duration("cache-ttl", 60*time.Second, "How long to cache refs fetched from git (0 disables caching)")
+	cacheNegativeTTLFlag = flag.Duration("cache-negative-ttl", 10*time.Second, "How long to remember that a git repository does not exist")
+
+	cspFlag        = flag.Bool("csp", false, "Send a Content-Security-Policy with a per-response nonce for inline scripts on HTML pages")
+	pageScriptFlag = flag.String("page-script", "", "JavaScript file to inline into HTML pages (e.g. analytics)")
+
+	dumbProtocolFlag = flag.Bool("dumb-protocol", false, "Fall back to the dumb HTTP protocol for git hosts that do not support the smart one")
+	dumbFallbackFlag = flag.Bool("dumb-fallback", false, "Try the dumb HTTP protocol when fetching smart protocol refs times out")
+
+	compressFlag        = flag.String("compress", "", "Comma-separated response encodings to offer, in order of preference (gzip, br with -tags brotli)")
+	compressMinSizeFlag = flag.Int("compress-min-size", 1024, "Smallest response body, in bytes, that is compressed")
+
+	metricsFlag = flag.Bool("metrics", false, "Serve Prometheus metrics at /_/metrics")
+
+	historySizeFlag = flag.Int("history-size", 0, "Number of resolution changes to keep per package, served at /_/admin/history (0 disables the history)")
+	adminTokenFlag  = flag.String("admin-token", "", "Bearer token required by the /_/admin/ endpoints, which are refused without one")
+
+	auditLogFlag  = flag.String("audit-log", "", "Write resolution decisions as JSON lines to the given file")
+	auditRateFlag = flag.Float64("audit-sample-rate", 1, "Fraction (0 to 1) of resolution decisions written to -audit-log")
 )
 
-var packagePattern = regexp.MustCompile(`^/([-a-zA-Z0-9]+)\.?(v([0-9]*))?(.*)$`)
+var packagePattern = regexp.MustCompile(`^/([-a-zA-Z0-9]+)\.?(v([0-9]*)(?:\.([0-9]+)(?:\.([0-9]+))?)?)?(.*)$`)
+
+// modulePathPattern matches the major version suffix of module paths (e.g.:
+// /v4 in /db/v4/mongo), which only exists from v2 on.
+var modulePathPattern = regexp.MustCompile(`^/v([2-9]|[1-9][0-9]+)(/.*)?$`)
+
+// subPathPattern matches what may follow a package name and version: a
+// subpackage path or a git request, within the characters of import paths.
+var subPathPattern = regexp.MustCompile(`^[-a-zA-Z0-9._~+/]*$`)
 
 var httpClient = &http.Client{Timeout: 10 * time.Second}
 
+// auditLog records resolution decisions when -audit-log is set.
+var auditLog *auditLogger
+
+// cache keeps fetched refs when -cache-ttl is set.
+var cache *refsCache
+
+// pageScript is the JavaScript read from -page-script.
+var pageScript string
+
+// vanityHosts picks the vanity host from the request when -allowed-hosts is
+// set.
+var vanityHosts *hostPolicy
+
 const refsSuffix = ".git/info/refs?service=git-upload-pack"
 
+const dumbRefsSuffix = ".git/info/refs"
+
+// Import path styles for versioned packages.
+const (
+	gopkgStyle   = "gopkg"   // upper.io/db.v4
+	modulesStyle = "modules" // upper.io/db/v4
+)
+
+// edgeChannel selects the tip of the default branch.
+const edgeChannel = "edge"
+
 // Error messages.
 var (
 	ErrNoRepo    = errors.New("repository not found")
 	ErrNoVersion = errors.New("version reference not found")
+
+	// ErrSSORequired is returned when the git host, GitHub, only serves the
+	// repository once SAML SSO is authorized for the credentials in use.
+	ErrSSORequired = errors.New("SSO authorization required")
 )
 
 func main() {
@@ -51,47 +135,168 @@ func run() error {
 		return fmt.Errorf("must provide -addr")
 	}
 
-	if *repoRootFlag == "" {
-		return fmt.Errorf("must provide -repo-root")
+	if *moduleStyleFlag != gopkgStyle && *moduleStyleFlag != modulesStyle {
+		return fmt.Errorf("-module-style must be %s or %s", gopkgStyle, modulesStyle)
 	}
 
-	if *vanityRootFlag == "" {
-		return fmt.Errorf("must provide -vanity-root")
+	if *ssoStatusFlag != http.StatusBadGateway && *ssoStatusFlag != http.StatusForbidden {
+		return fmt.Errorf("-sso-status must be %d or %d", http.StatusBadGateway, http.StatusForbidden)
 	}
 
-	repoRoot, err := NewRepoRoot(*repoRootFlag, *vanityRootFlag)
+	var err error
+	source, err = parseSourceTemplate(*sourceTemplateFlag)
 	if err != nil {
-		return fmt.Errorf("could not parse -repo-root: %q", err)
+		return fmt.Errorf("could not parse -source-template: %q", err)
 	}
 
-	var listenAddr, listenNet string
+	cfg := &Config{}
+	if *configFlag != "" {
+		cfg, err = loadConfig(*configFlag)
+		if err != nil {
+			return fmt.Errorf("could not load -config: %q", err)
+		}
 
-	if *socketFlag != "" {
-		listenNet, listenAddr = "unix", *socketFlag
-	} else {
-		listenNet, listenAddr = "tcp", *addrFlag
+		if err := applyFeatures(flag.CommandLine, cfg, *envFlag); err != nil {
+			return fmt.Errorf("could not apply features: %q", err)
+		}
+	}
+
+	// Logging is set up after features, which may change -log-level.
+	if logger, err = newLogger(os.Stderr, *logFormatFlag, *logLevelFlag); err != nil {
+		return err
+	}
+	if *logFormatFlag == "json" {
+		slog.SetDefault(logger)
+	}
+
+	roots, err := newRepoRoots(cfg)
+	if err != nil {
+		return fmt.Errorf("could not load roots from -config: %q", err)
+	}
+
+	if len(roots) == 0 || *repoRootFlag != "" || *vanityRootFlag != "" {
+		if *repoRootFlag == "" {
+			return fmt.Errorf("must provide -repo-root")
+		}
+
+		if *vanityRootFlag == "" {
+			return fmt.Errorf("must provide -vanity-root")
+		}
+	}
+
+	var repoRoot *RepoRoot
+	if *repoRootFlag != "" {
+		repoRoot, err = NewRepoRoot(*repoRootFlag, *vanityRootFlag)
+		if err != nil {
+			return fmt.Errorf("could not parse -repo-root: %q", err)
+		}
+		repoRoot.Packages = cfg.Packages
 	}
 
-	li, err := net.Listen(listenNet, listenAddr)
+	if len(roots) > 0 {
+		if repoRoot != nil {
+			roots = append(roots, repoRoot)
+		}
+		repoRoots = roots
+	}
+
+	if trustedProxies, err = parseProxies(*trustedProxiesFlag); err != nil {
+		return fmt.Errorf("could not parse -trusted-proxies: %q", err)
+	}
+	if *allowedHostsFlag != "" {
+		vanityHosts, err = newHostPolicy(*trustedProxiesFlag, *allowedHostsFlag)
+		if err != nil {
+			return fmt.Errorf("could not parse -trusted-proxies: %q", err)
+		}
+	}
+
+	if *pageScriptFlag != "" {
+		script, err := ioutil.ReadFile(*pageScriptFlag)
+		if err != nil {
+			return fmt.Errorf("could not read -page-script: %q", err)
+		}
+		pageScript = string(script)
+	}
+
+	encodings, err = parseEncodings(*compressFlag)
+	if err != nil {
+		return fmt.Errorf("could not parse -compress: %q", err)
+	}
+
+	if *cacheTTLFlag > 0 {
+		cache = newRefsCache(*cacheTTLFlag, *cacheNegativeTTLFlag)
+	}
+
+	if *metricsFlag {
+		metrics = newMetrics()
+	}
+
+	if *historySizeFlag > 0 {
+		if *adminTokenFlag == "" {
+			return fmt.Errorf("-history-size requires -admin-token")
+		}
+		history = newResolutionHistory(*historySizeFlag)
+	}
+
+	if *auditLogFlag != "" {
+		if *auditRateFlag < 0 || *auditRateFlag > 1 {
+			return fmt.Errorf("-audit-sample-rate must be between 0 and 1")
+		}
+		f, err := os.OpenFile(*auditLogFlag, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open -audit-log: %q", err)
+		}
+		defer f.Close()
+		auditLog = newAuditLogger(f, *auditRateFlag)
+	}
+
+	servers, err := newServers(http.HandlerFunc(newHandler(repoRoot)))
 	if err != nil {
-		return fmt.Errorf("Failed to bind to %s %s: %v", listenNet, listenAddr, err)
+		return err
 	}
 
-	http.HandleFunc("/", newHandler(repoRoot))
+	served := repoRoots
+	if served == nil {
+		served = []*RepoRoot{repoRoot}
+	}
+	for _, root := range served {
+		logger.Info(fmt.Sprintf("Serving %s -> %s", root.VanityHostPath, root.RepoHostPath))
+	}
 
-	log.Printf("Listening at %s. %s -> %s", listenAddr, *vanityRootFlag, *repoRootFlag)
+	errc := make(chan error, len(servers))
+	for _, s := range servers {
+		logger.Info(fmt.Sprintf("Listening at %s.", s.listener.Addr()))
+		go func(s *server) { errc <- s.serve() }(s)
+	}
+	return <-errc
+}
 
-	return http.Serve(li, nil)
+// listen announces on the given network address, accepting at most maxConns
+// simultaneous connections if maxConns is positive.
+func listen(network, addr string, maxConns int) (net.Listener, error) {
+	li, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if maxConns > 0 {
+		li = netutil.LimitListener(li, maxConns)
+	}
+	return li, nil
 }
 
 var gogetTemplate = template.Must(template.New("").Parse(`
 <html>
 <head>
 <meta name="go-import" content="{{.VanityPath}} git {{.VanityURL}}">
-<meta name="go-source" content="{{.VanityPath}} _ {{.RepoRootURL}}/tree/{{.GitTree}}{/dir} {{.RepoRootURL}}/blob/{{.GitTree}}{/dir}/{file}#L{line}">
+{{- with .SourceLinks}}
+<meta name="go-source" content="{{$.VanityPath}} _ {{.Dir}} {{.File}}">
+{{- end}}
+{{- if .Script}}
+<script{{with .Nonce}} nonce="{{.}}"{{end}}>{{.Script}}</script>
+{{- end}}
 </head>
 <body>
-go get {{.VanityPath}}
+go get {{.ImportPath}}
 </body>
 </html>
 `))
@@ -102,6 +307,9 @@ type RepoRoot struct {
 	repoURL        *url.URL
 	RepoHostPath   string
 	VanityHostPath string
+
+	// Packages holds per-package settings, by package name.
+	Packages map[string]*PackageConfig
 }
 
 func parseRepoURL(in string) (*url.URL, error) {
@@ -135,12 +343,30 @@ func NewRepoRoot(repoURL string, vanityURL string) (*RepoRoot, error) {
 	}, nil
 }
 
+// WithVanityHost returns a copy of root that uses the given vanity host.
+func (root *RepoRoot) WithVanityHost(host string) *RepoRoot {
+	if host == root.vanityURL.Host {
+		return root
+	}
+	v := *root.vanityURL
+	v.Host = host
+
+	r := *root
+	r.vanityURL = &v
+	r.VanityHostPath = v.Host + v.Path
+	return &r
+}
+
 // NewRepo creates a new repository.
 func (root *RepoRoot) NewRepo(name string) *Repo {
-	return &Repo{
+	repo := &Repo{
 		Root: root,
 		Name: name,
 	}
+	if cfg := root.Packages[name]; cfg != nil {
+		repo.Config = *cfg
+	}
+	return repo
 }
 
 // Repo represents a source code repository on GitHub.
@@ -150,9 +376,48 @@ type Repo struct {
 	Name  string
 	Major string
 
+	// Minor and Patch pin the requested version further, if set.
+	Minor string
+	Patch string
+
+	// SubPath is the path of the subpackage requested under the package
+	// (e.g.: /mongo for upper.io/db.v4/mongo), if any.
+	SubPath string
+
+	// ModulePath is set when the version was requested in the module path
+	// form (e.g.: upper.io/db/v4) instead of the .vN one.
+	ModulePath bool
+
+	// Config holds the package settings.
+	Config PackageConfig
+
+	// Channel is the release channel requested instead of a version (e.g.
+	// "edge"), if any.
+	Channel string
+
+	// DefaultBranch is the branch HEAD points to upstream, if known.
+	DefaultBranch string
+
+	// Dumb is set when the repository is only served with the dumb HTTP
+	// protocol.
+	Dumb bool
+
+	// Logger logs for the request the repository is resolved for. If nil,
+	// lines go to logger.
+	Logger *slog.Logger
+
 	RequestedVersion semver.Version
 
-	// FullVersion is the best version in AllVersions that matches MajorVersion.
+	// Recommended is the version unversioned requests resolve to instead of
+	// the latest one, from the package settings, if any.
+	Recommended *semver.Version
+
+	// Constraint narrows down the versions that match the request, if
+	// given with ?constraint=.
+	Constraint *versionConstraint
+
+	// FullVersion is the best version in AllVersions that matches the
+	// requested version.
 	// It defaults to InvalidVersion if there are no matches.
 	FullVersion *semver.Version
 
@@ -166,13 +431,101 @@ type Repo struct {
 // package versions are available in the repository.
 func (repo *Repo) SetVersions(all semver.Versions) {
 	repo.AllVersions = all
+	if repo.Channel == edgeChannel {
+		return
+	}
 	for _, v := range repo.AllVersions {
-		if v.Major == repo.RequestedVersion.Major && (repo.FullVersion == nil || repo.FullVersion.LessThan(*v)) {
+		if repo.Matches(v) && preferVersion(v, repo.FullVersion) {
 			repo.FullVersion = v
 		}
 	}
 }
 
+// preferVersion reports whether v is preferred over best, the best version
+// found so far, if any. Tags win over branches, and higher versions win.
+// Among versions of equal precedence, which differ only in build metadata
+// (e.g. v2.3.0+a and v2.3.0+b), the greater version string wins, so the choice
+// does not depend on the order of the tags.
+func preferVersion(v, best *semver.Version) bool {
+	if best == nil {
+		return true
+	}
+	if isBranchVersion(v) != isBranchVersion(best) {
+		return !isBranchVersion(v)
+	}
+	if c := v.Compare(*best); c != 0 {
+		return c > 0
+	}
+	return v.String() > best.String()
+}
+
+// branchMetadata marks the versions that stand for a maintenance branch (e.g.:
+// refs/heads/v2) instead of a tag.
+const branchMetadata = "branch"
+
+// branchVersion returns the version that stands for the vN branch of major.
+func branchVersion(major int64) *semver.Version {
+	return &semver.Version{Major: major, Metadata: branchMetadata}
+}
+
+// isBranchVersion reports whether v stands for a vN branch.
+func isBranchVersion(v *semver.Version) bool {
+	return v.Metadata == branchMetadata && v.Minor == 0 && v.Patch == 0 && v.PreRelease == ""
+}
+
+// versionString returns v with a "v" prefix (e.g. "v2.1.0"), or the branch
+// name (e.g. "v2") if v stands for a branch.
+func versionString(v *semver.Version) string {
+	if isBranchVersion(v) {
+		return "v" + strconv.FormatInt(v.Major, 10)
+	}
+	return "v" + v.String()
+}
+
+// Matches reports whether v satisfies the requested version. Versions match
+// on the major and, when given, on the minor and patch numbers as well.
+// Pre-releases never match unless -include-prereleases is set. With a
+// recommended version, only that one matches. Branches only match requests
+// for a major. With a constraint, versions must satisfy it as well, and
+// unversioned requests match any major.
+func (repo *Repo) Matches(v *semver.Version) bool {
+	if repo.Recommended != nil {
+		return !isBranchVersion(v) && v.Equal(*repo.Recommended)
+	}
+	if isBranchVersion(v) && (repo.Minor != "" || repo.Constraint != nil) {
+		return false
+	}
+	if v.PreRelease != "" && !*includePrereleasesFlag {
+		return false
+	}
+	if repo.Constraint != nil {
+		if !repo.Constraint.Match(v) {
+			return false
+		}
+		if repo.Major == "" {
+			return true
+		}
+	}
+	if v.Major != repo.RequestedVersion.Major {
+		return false
+	}
+	if repo.Minor != "" && v.Minor != repo.RequestedVersion.Minor {
+		return false
+	}
+	if repo.Patch != "" && v.Patch != repo.RequestedVersion.Patch {
+		return false
+	}
+	return true
+}
+
+// Log returns the logger of the request the repository is resolved for.
+func (repo *Repo) Log() *slog.Logger {
+	if repo.Logger == nil {
+		return logger
+	}
+	return repo.Logger
+}
+
 // RepoRoot returns the repository root, without a schema.
 func (repo *Repo) RepoRoot() string {
 	return repo.Root.RepoHostPath + "/" + repo.Name
@@ -185,23 +538,114 @@ func (repo *Repo) VanityRoot() string {
 
 // GitTree returns the repository tree name for the selected version.
 func (repo *Repo) GitTree() string {
-	if repo.FullVersion == nil || repo.Major == "" {
+	if repo.Channel == edgeChannel && repo.DefaultBranch != "" {
+		return repo.DefaultBranch
+	}
+	if repo.FullVersion == nil || repo.Major == "" && repo.Config.DefaultMajor == 0 && repo.Recommended == nil {
+		if repo.Config.DefaultRef != "" {
+			return repo.Config.DefaultRef
+		}
 		return "master"
 	}
+	if isBranchVersion(repo.FullVersion) {
+		return versionString(repo.FullVersion)
+	}
 	return repo.FullVersion.String()
 }
 
-// VanityPath returns the real package path, without a schema.
+// VanityPath returns the real package path, without a schema. With the
+// modules style, majors from v2 on are a /vN suffix and v0 and v1 have none,
+// and only the major is kept, without leading zeros, as the go command
+// expects.
 func (repo *Repo) VanityPath() string {
 	if repo.Major == "" {
 		return repo.VanityRoot()
 	}
-	return repo.VanityRoot() + ".v" + repo.Major
+	if repo.ModulePath || *moduleStyleFlag == modulesStyle {
+		if repo.RequestedVersion.Major < 2 {
+			return repo.VanityRoot()
+		}
+		return repo.VanityRoot() + "/v" + strconv.FormatInt(repo.RequestedVersion.Major, 10)
+	}
+	return repo.VanityRoot() + "." + repo.RequestedVersionString()
+}
+
+// RobotsTag returns the X-Robots-Tag header for the HTML pages of the
+// package, from its settings or -robots-tag, or an empty string for none.
+func (repo *Repo) RobotsTag() string {
+	if repo.Config.RobotsTag != "" {
+		return repo.Config.RobotsTag
+	}
+	return *robotsTagFlag
+}
+
+// ImportPath returns the path of the requested package or subpackage,
+// without a schema.
+func (repo *Repo) ImportPath() string {
+	return repo.VanityPath() + repo.SubPath
+}
+
+// DocsURL returns the -docs-url of the requested package or subpackage.
+func (repo *Repo) DocsURL() string {
+	return strings.Replace(*docsURLFlag, "{vanity}", repo.ImportPath(), -1)
+}
+
+// gitPath returns the path git is pointed to, without a schema. It always
+// uses the .vN form, so requests for refs get rewritten to the right version.
+func (repo *Repo) gitPath() string {
+	if repo.Channel != "" {
+		return repo.VanityRoot() + "." + repo.Channel
+	}
+	if repo.Major == "" {
+		return repo.VanityRoot()
+	}
+	return repo.VanityRoot() + "." + repo.RequestedVersionString()
+}
+
+// historyKey returns the package path resolutions are recorded under, with
+// the channel or the requested major in the gopkg style (e.g.:
+// upper.io/db.v4), however the request spelled it.
+func (repo *Repo) historyKey() string {
+	switch {
+	case repo.Channel != "":
+		return repo.VanityRoot() + "." + repo.Channel
+	case repo.Major == "":
+		return repo.VanityRoot()
+	}
+	return repo.VanityRoot() + ".v" + strconv.FormatInt(repo.RequestedVersion.Major, 10)
+}
+
+// RequestedVersionString returns the version or channel given in the request
+// (e.g. "v2", "v2.1" or "edge"), or an empty string if none was requested.
+func (repo *Repo) RequestedVersionString() string {
+	if repo.Channel != "" {
+		return repo.Channel
+	}
+	if repo.Major == "" {
+		return ""
+	}
+	s := "v" + repo.Major
+	if repo.Minor != "" {
+		s += "." + repo.Minor
+		if repo.Patch != "" {
+			s += "." + repo.Patch
+		}
+	}
+	return s
+}
+
+// ResolvedVersionString returns the selected version (e.g. "v2.1.0"), or an
+// empty string if no version was selected.
+func (repo *Repo) ResolvedVersionString() string {
+	if repo.FullVersion == nil {
+		return ""
+	}
+	return versionString(repo.FullVersion)
 }
 
 // VanityURL returns the vanity package's URL.
 func (repo *Repo) VanityURL() string {
-	return repo.Root.vanityURL.Scheme + "://" + repo.VanityPath()
+	return repo.Root.vanityURL.Scheme + "://" + repo.gitPath()
 }
 
 // RepoRootURL returns the real package's URL.
@@ -209,13 +653,52 @@ func (repo *Repo) RepoRootURL() string {
 	return repo.Root.repoURL.Scheme + "://" + repo.RepoRoot()
 }
 
+// SourceRootURL returns the URL source code links point to.
+func (repo *Repo) SourceRootURL() string {
+	if repo.Config.SourceRoot != "" {
+		return strings.TrimSuffix(repo.Config.SourceRoot, "/")
+	}
+	return repo.RepoRootURL()
+}
+
 func newHandler(repoRoot *RepoRoot) func(http.ResponseWriter, *http.Request) {
 	return func(resp http.ResponseWriter, req *http.Request) {
+		resp = withEncoding(resp, req)
+
 		if req.URL.Path == "/health-check" {
-			resp.Write([]byte("ok"))
+			writeBody(resp, http.StatusOK, []byte("ok"))
+			return
+		}
+		if metrics != nil && req.URL.Path == metricsPath {
+			metrics.Handler().ServeHTTP(resp, req)
+			return
+		}
+		if history != nil && req.URL.Path == historyPath {
+			serveHistory(resp, req)
+			return
+		}
+		id := newRequestID()
+		resp.Header().Set("X-Request-ID", id)
+		req = withRequestLogger(req, id)
+		rlog := requestLogger(req)
+
+		var outcome string
+		defer func(start time.Time) {
+			attrs := []any{"method", req.Method, "path", req.URL.Path, "duration", time.Since(start)}
+			if outcome != "" {
+				attrs = append(attrs, "outcome", outcome)
+			}
+			rlog.Info(fmt.Sprintf("%s requested %s", req.RemoteAddr, req.URL), attrs...)
+		}(time.Now())
+
+		// Runs of slashes and dot segments were already redirected to the
+		// clean path by the ServeMux the handler is mounted on (see
+		// newServers), but backslashes are rejected rather than taken as
+		// separators.
+		if strings.ContainsRune(req.URL.Path, '\\') {
+			writeBody(resp, http.StatusBadRequest, []byte("Invalid character in request path."))
 			return
 		}
-		log.Printf("%s requested %s", req.RemoteAddr, req.URL)
 
 		if req.URL.Path == "/" {
 			sendNotFound(resp, "Missing package name.")
@@ -228,37 +711,201 @@ func newHandler(repoRoot *RepoRoot) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		p := packagePattern.FindStringSubmatch(u.Path)
+		path := u.Path
+		isProxy := *goproxyFlag && strings.HasPrefix(path, proxyPrefix)
+
+		root := repoRoot
+		switch {
+		case repoRoots != nil && isProxy:
+			root, _ = matchRoot(repoRoots, strings.TrimPrefix(path, proxyPrefix))
+		case repoRoots != nil:
+			host := req.Host
+			if vanityHosts != nil {
+				host = vanityHosts.Host(req)
+			}
+			root, path = matchHostRoot(repoRoots, strings.ToLower(host), path)
+		default:
+			if host := vanityHosts.Host(req); host != "" {
+				root = root.WithVanityHost(host)
+			}
+		}
+		if root == nil {
+			sendNotFound(resp, "No repository root matches %s.", req.Host+u.Path)
+			return
+		}
+
+		if isProxy {
+			serveProxy(resp, req, root)
+			return
+		}
+
+		if *listPackagesFlag && path == packagesPath {
+			roots := repoRoots
+			if roots == nil {
+				roots = []*RepoRoot{root}
+			}
+			servePackages(resp, roots)
+			return
+		}
+
+		p := packagePattern.FindStringSubmatch(path)
+		if p == nil {
+			sendNotFound(resp, "Missing package name.")
+			return
+		}
+
+		pkgName, version, minor, patch, extra := p[1], p[3], p[4], p[5], p[6]
+		if extra != versionsSuffix && !subPathPattern.MatchString(extra) {
+			sendNotFound(resp, "Invalid package path.")
+			return
+		}
+		repo := root.NewRepo(pkgName)
+		repo.Logger = rlog
+
+		if version == "" && minor != "" {
+			sendNotFound(resp, "Missing major version.")
+			return
+		}
+
+		if m := modulePathPattern.FindStringSubmatch(extra); version == "" && minor == "" && m != nil {
+			version, extra = m[1], m[2]
+			repo.ModulePath = true
+		}
 
-		pkgName, _, version, extra := p[1], p[2], p[3], p[4]
-		repo := repoRoot.NewRepo(pkgName)
+		channel := req.FormValue("channel")
+		if version == "" && (extra == edgeChannel || strings.HasPrefix(extra, edgeChannel+"/")) {
+			channel, extra = edgeChannel, extra[len(edgeChannel):]
+		}
+		metrics.Request(requestType(req, extra))
+		if extra != "" && extra[0] != '/' {
+			sendNotFound(resp, "Invalid version in %s.", path)
+			return
+		}
+		if !isGitPath(extra) && extra != versionsSuffix {
+			repo.SubPath = extra
+		}
+
+		switch {
+		case channel == "":
+		case channel != edgeChannel:
+			sendNotFound(resp, "Unknown channel %q.", channel)
+			return
+		case version != "":
+			sendNotFound(resp, "Channel %q cannot be combined with a version.", channel)
+			return
+		default:
+			repo.Channel = channel
+		}
+
+		if req.URL.Query().Has("constraint") {
+			if repo.Channel != "" {
+				sendNotFound(resp, "Channel %q cannot be combined with a constraint.", repo.Channel)
+				return
+			}
+			if repo.Constraint, err = parseConstraint(req.URL.Query().Get("constraint")); err != nil {
+				writeBody(resp, http.StatusBadRequest, []byte(err.Error()))
+				return
+			}
+		}
 
-		var requestedVersion semver.Version
 		if version != "" {
-			repo.Major = version
+			repo.Major, repo.Minor, repo.Patch = version, minor, patch
 			repo.RequestedVersion.Major, _ = strconv.ParseInt(repo.Major, 10, 64)
+			repo.RequestedVersion.Minor, _ = strconv.ParseInt(repo.Minor, 10, 64)
+			repo.RequestedVersion.Patch, _ = strconv.ParseInt(repo.Patch, 10, 64)
+		} else if repo.Constraint != nil {
+			// Versions of any major may satisfy the constraint.
+		} else if v := repo.Config.RecommendedVersion(); v != nil && repo.Channel == "" {
+			repo.RequestedVersion.Major = v.Major
+			repo.Recommended = v
+		} else {
+			repo.RequestedVersion.Major = repo.Config.DefaultMajor
 		}
 
 		var changed []byte
 		var versions semver.Versions
 		original, err := fetchRefs(repo)
 		if err == nil {
-			changed, versions, err = changeRefs(original, &repo.RequestedVersion)
+			match := repo.Matches
+			if repo.Channel == edgeChannel {
+				match = nil
+			}
+			changed, versions, err = resolveRefs(repo, original, match)
 			repo.SetVersions(versions)
 		}
 
-		switch err {
-		case nil:
-			// all ok
-		case ErrNoRepo:
+		switch {
+		case err == nil:
+			outcome = outcomeOK
+			metrics.Outcome(outcome)
+		case err == ErrNoRepo:
+			outcome = outcomeNoRepo
+			metrics.Outcome(outcome)
 			sendNotFound(resp, "Git repository not found at https://%s", repo.RepoRoot())
 			return
-		case ErrNoVersion:
-			sendNotFound(resp, `Git repository at https://%s has no tag %v`, repo.RepoRoot(), requestedVersion)
+		case err == ErrNoVersion && repo.Major == "" && (extra == versionsSuffix || req.URL.Query().Has("versions")):
+			// Unversioned requests for the versions list them all, with
+			// none selected, when there is no v0 or v1 to resolve to.
+			outcome = outcomeNoVersion
+			metrics.Outcome(outcome)
+			if _, versions, err = changeRefs(original, nil, *allowLightweightTagsFlag); err != nil {
+				sendNotFound(resp, "Git repository at https://%s has no versions", repo.RepoRoot())
+				return
+			}
+			repo.SetVersions(versions)
+			serveVersions(resp, repo)
+			return
+		case err == ErrNoVersion:
+			outcome = outcomeNoVersion
+			metrics.Outcome(outcome)
+			tag := repo.RequestedVersionString()
+			if repo.Constraint != nil {
+				tag = strings.TrimSpace(tag + " matching " + repo.Constraint.String())
+			}
+			sendNotFound(resp, `Git repository at https://%s has no tag %s`, repo.RepoRoot(), tag)
+			return
+		case errors.Is(err, ErrSSORequired):
+			outcome = outcomeBadGateway
+			metrics.Outcome(outcome)
+			rlog.Warn(fmt.Sprintf("Git repository at https://%s: %v", repo.RepoRoot(), err))
+			writeBody(resp, *ssoStatusFlag, []byte(fmt.Sprintf("Git repository at https://%s requires SSO authorization: %v", repo.RepoRoot(), err)))
 			return
 		default:
-			resp.WriteHeader(http.StatusBadGateway)
-			resp.Write([]byte(fmt.Sprintf("Cannot obtain refs from Git: %v", err)))
+			outcome = outcomeBadGateway
+			metrics.Outcome(outcome)
+			writeBody(resp, http.StatusBadGateway, []byte(fmt.Sprintf("Cannot obtain refs from Git: %v", err)))
+			return
+		}
+
+		var commit string
+		commit, repo.DefaultBranch = refsHead(changed)
+		repo.Config.setSunset(resp.Header())
+
+		auditLog.Record(auditEntry{
+			ClientIP:         clientIP(req),
+			Package:          repo.VanityRoot(),
+			Subpackage:       repo.SubPath,
+			RequestedVersion: repo.RequestedVersionString(),
+			ResolvedVersion:  repo.ResolvedVersionString(),
+			ResolvedCommit:   commit,
+		})
+		if repo.Constraint != nil {
+			serveConstraint(resp, repo, commit)
+			return
+		}
+		if repo.Minor == "" {
+			// Requests that pin a minor or patch version do not follow
+			// the releases of their major.
+			history.Record(repo.historyKey(), repo.ResolvedVersionString(), commit)
+		}
+
+		if extra == versionsSuffix || req.URL.Query().Has("versions") {
+			serveVersions(resp, repo)
+			return
+		}
+
+		if repo.Dumb && isGitPath(extra) {
+			serveDumb(resp, req, repo, extra, changed)
 			return
 		}
 
@@ -277,7 +924,7 @@ func newHandler(repoRoot *RepoRoot) func(http.ResponseWriter, *http.Request) {
 
 			proxyRes, err := http.DefaultClient.Do(proxyReq)
 			if err != nil {
-				log.Printf("Proxy: %v", err)
+				rlog.Error(fmt.Sprintf("Proxy: %v", err))
 				resp.WriteHeader(http.StatusServiceUnavailable)
 				return
 			}
@@ -289,153 +936,438 @@ func newHandler(repoRoot *RepoRoot) func(http.ResponseWriter, *http.Request) {
 
 			buf, err := ioutil.ReadAll(proxyRes.Body)
 			if err != nil {
-				log.Printf("Proxy: %v", err)
+				rlog.Error(fmt.Sprintf("Proxy: %v", err))
 				resp.WriteHeader(http.StatusBadGateway)
 				return
 			}
 
 			if _, err = resp.Write(buf); err != nil {
-				log.Printf("Proxy: %v", err)
+				rlog.Error(fmt.Sprintf("Proxy: %v", err))
 				resp.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 			return
 		case `/info/refs`:
-			resp.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
-			resp.Write(changed)
+			resp.Header().Set("Content-Type", smartContentType)
+			writeBody(resp, http.StatusOK, changed)
 			return
 		}
 
 		resp.Header().Set("Content-Type", "text/html")
-		if req.FormValue("go-get") == "1" {
-			// execute simple template when this is a go-get request
-			err = gogetTemplate.Execute(resp, repo)
-			if err != nil {
-				log.Printf("error executing go get template: %s\n", err)
-			}
+		goGet := req.FormValue("go-get") == "1"
+		if !goGet && *docsURLFlag == "" {
+			sendNotFound(resp, "Missing ?go-get=1 parameter.")
 			return
 		}
 
-		sendNotFound(resp, "Missing ?go-get=1 parameter.")
+		// execute simple template when this is a go-get request, and also
+		// for browsers sent to the docs so crawlers still find the meta tags
+		data, err := newPageData(resp, repo)
+		if err != nil {
+			rlog.Error(fmt.Sprintf("error preparing go get page: %s", err))
+			sendError(resp, "Failed to render page")
+			return
+		}
+		var buf bytes.Buffer
+		err = gogetTemplate.Execute(&buf, data)
+		if err != nil {
+			rlog.Error(fmt.Sprintf("error executing go get template: %s", err))
+			sendError(resp, "Failed to render page")
+			return
+		}
+		if tag := repo.RobotsTag(); tag != "" {
+			resp.Header().Set("X-Robots-Tag", tag)
+		}
+		if !goGet {
+			resp.Header().Set("Location", repo.DocsURL())
+			writeBody(resp, http.StatusFound, buf.Bytes())
+			return
+		}
+		writeBody(resp, http.StatusOK, buf.Bytes())
+	}
+}
+
+// isGitPath reports whether extra, the path after a package, is one that git
+// requests rather than a subpackage.
+func isGitPath(extra string) bool {
+	switch {
+	case extra == "/info/refs", extra == "/git-upload-pack", extra == "/HEAD", strings.HasPrefix(extra, "/objects/"):
+		return true
 	}
+	return false
 }
 
 func sendError(resp http.ResponseWriter, msg string, args ...interface{}) {
 	if len(args) > 0 {
 		msg = fmt.Sprintf(msg, args...)
 	}
-	resp.WriteHeader(http.StatusInternalServerError)
-	resp.Write([]byte(msg))
+	writeBody(resp, http.StatusInternalServerError, []byte(msg))
 }
 
 func sendNotFound(resp http.ResponseWriter, msg string, args ...interface{}) {
 	if len(args) > 0 {
 		msg = fmt.Sprintf(msg, args...)
 	}
-	resp.WriteHeader(http.StatusNotFound)
-	resp.Write([]byte(msg))
+	writeBody(resp, http.StatusNotFound, []byte(msg))
+}
+
+// writeBody sends body with the given status and an explicit Content-Length,
+// compressing it if an encoding was negotiated for the request.
+func writeBody(resp http.ResponseWriter, status int, body []byte) {
+	if w, ok := resp.(*encodingWriter); ok {
+		body = w.encode(body)
+	}
+	resp.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	resp.WriteHeader(status)
+	resp.Write(body)
+}
+
+// resolveRefs rewrites original with changeRefs for the version requested
+// from repo, reusing earlier results for the same version if -cache-ttl is
+// set.
+func resolveRefs(repo *Repo, original []byte, match func(*semver.Version) bool) (changed []byte, versions semver.Versions, err error) {
+	if cache == nil {
+		return changeRefs(original, match, *allowLightweightTagsFlag)
+	}
+	key := repo.RequestedVersionString()
+	if repo.Constraint != nil {
+		key += "?constraint=" + repo.Constraint.String()
+	}
+	entry := cache.Resolve(repo.RepoRoot(), key, original, func() resolvedEntry {
+		changed, versions, err := changeRefs(original, match, *allowLightweightTagsFlag)
+		return resolvedEntry{changed: changed, versions: versions, err: err}
+	})
+	return entry.changed, entry.versions, entry.err
 }
 
+// fetchRefs obtains the refs advertisement of repo, from the cache if
+// -cache-ttl is set.
 func fetchRefs(repo *Repo) (data []byte, err error) {
-	repoURL := repo.RepoRootURL() + refsSuffix
-	resp, err := httpClient.Get(repoURL)
+	if cache == nil {
+		return fetchUpstreamRefs(repo)
+	}
+	entry := cache.Fetch(repo.RepoRoot(), func() refsEntry {
+		r := *repo
+		data, err := fetchUpstreamRefs(&r)
+		return refsEntry{data: data, dumb: r.Dumb, err: err}
+	})
+	repo.Dumb = entry.dumb
+	return entry.data, entry.err
+}
+
+// fetchUpstreamRefs obtains the refs advertisement of repo from the git host.
+func fetchUpstreamRefs(repo *Repo) (data []byte, err error) {
+	defer metrics.ObserveFetch(time.Now())
+	defer func(start time.Time) {
+		attrs := []any{"duration", time.Since(start)}
+		if err != nil {
+			attrs = append(attrs, "error", err)
+		}
+		repo.Log().Debug(fmt.Sprintf("Fetched refs of %s", repo.RepoRoot()), attrs...)
+	}(time.Now())
+
+	data, smart, err := getRefs(repo.RepoRootURL() + refsSuffix)
+	dumb := *dumbProtocolFlag
+	if err != nil && *dumbFallbackFlag && isTimeout(err) {
+		repo.Log().Warn(fmt.Sprintf("Smart refs request for %s timed out, trying the dumb protocol", repo.RepoRoot()))
+		data, smart, err = getRefs(repo.RepoRootURL() + dumbRefsSuffix)
+		dumb = true
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if dumb && !smart {
+		head, err := fetchDumbHead(repo)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = dumbToSmart(data, head); err != nil {
+			return nil, err
+		}
+		repo.Dumb = true
+	}
+	return data, nil
+}
+
+// getRefs fetches the refs listing at refsURL and reports whether it is a
+// smart protocol advertisement.
+func getRefs(refsURL string) (data []byte, smart bool, err error) {
+	resp, err := getWithRetries(refsURL, httpClient.Do)
 	if err != nil {
-		return nil, fmt.Errorf("cannot talk to git repository: %v", err)
+		return nil, false, fmt.Errorf("cannot talk to git repository: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if sso := resp.Header.Get("X-GitHub-SSO"); sso != "" && resp.StatusCode != 200 {
+		return nil, false, ssoError(sso)
+	}
+
 	switch resp.StatusCode {
 	case 200:
 		// ok
 	case 401, 404:
-		return nil, ErrNoRepo
+		return nil, false, ErrNoRepo
 	default:
-		return nil, fmt.Errorf("error from git repository: %v", resp.Status)
+		return nil, false, fmt.Errorf("error from git repository: %v", resp.Status)
 	}
 
 	data, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading from git: %v", err)
+		return nil, false, fmt.Errorf("error reading from git: %w", err)
 	}
-	return data, err
+	return data, isSmartResponse(resp), nil
 }
 
-func changeRefs(data []byte, major *semver.Version) (changed []byte, versions semver.Versions, err error) {
-	var hlinei, hlinej int // HEAD reference line start/end
-	var mlinei, mlinej int // master reference line start/end
-	var vrefhash string
-	var vrefname string
-	var vrefv *semver.Version
+// ssoError returns an error wrapping ErrSSORequired with a hint built from
+// the X-GitHub-SSO header, which looks like "required; url=<url>".
+func ssoError(header string) error {
+	for _, part := range strings.Split(header, ";") {
+		if part = strings.TrimSpace(part); strings.HasPrefix(part, "url=") {
+			return fmt.Errorf("%w: authorize the access token for the organization at %s", ErrSSORequired, part[4:])
+		}
+	}
+	return fmt.Errorf("%w: authorize the access token for the organization", ErrSSORequired)
+}
 
-	// Record all available versions, the locations of the master and HEAD lines,
-	// and details of the best reference satisfying the requested major version.
-	versions = semver.Versions{}
-	sdata := string(data)
+// isTimeout reports whether err was caused by a timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// forEachPktLine calls fn with the bounds [i, j) and the payload of each
+// pkt-line of a smart protocol advertisement, in order. Flush and other
+// special pkt-lines have an empty payload. Payloads are slices of data, so
+// nothing is copied.
+func forEachPktLine(data []byte, fn func(i, j int, payload []byte)) error {
 	for i, j := 0, 0; i < len(data); i = j {
-		size, err := strconv.ParseInt(sdata[i:i+4], 16, 32)
+		if i+4 > len(data) {
+			return fmt.Errorf("incomplete refs data received from git")
+		}
+		size, err := strconv.ParseInt(string(data[i:i+4]), 16, 32)
 		if err != nil {
-			return nil, nil, fmt.Errorf("cannot parse refs line size: %s", string(data[i:i+4]))
+			return fmt.Errorf("cannot parse refs line size: %s", data[i:i+4])
 		}
-		if size == 0 {
+		if size < 4 {
 			size = 4
 		}
 		j = i + int(size)
-		if j > len(sdata) {
-			return nil, nil, fmt.Errorf("incomplete refs data received from GitHub")
+		if j > len(data) {
+			return fmt.Errorf("incomplete refs data received from git")
 		}
-		if sdata[0] == '#' {
-			continue
+		fn(i, j, data[i+4:j])
+	}
+	return nil
+}
+
+// pktLines splits a smart protocol advertisement into the payloads of its
+// pkt-lines. Flush pkt-lines are returned as empty strings.
+func pktLines(data []byte) ([]string, error) {
+	var lines []string
+	err := forEachPktLine(data, func(i, j int, payload []byte) {
+		lines = append(lines, string(payload))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// writePktLine writes line into buf as a pkt-line.
+func writePktLine(buf *bytes.Buffer, line string) {
+	fmt.Fprintf(buf, "%04x%s", 4+len(line), line)
+}
+
+// refsHead returns the hash HEAD points to in the given refs advertisement
+// and the default branch announced with the symref capability, if any. The
+// hash is empty if there is no HEAD line.
+func refsHead(data []byte) (hash, branch string) {
+	lines, _ := pktLines(data)
+	for _, line := range lines {
+		if len(line) > 45 && line[40:45] == " HEAD" && (line[45] == '\x00' || line[45] == '\n') {
+			for _, c := range strings.Fields(line[46:]) {
+				if strings.HasPrefix(c, "symref=HEAD:refs/heads/") {
+					branch = strings.TrimPrefix(c, "symref=HEAD:refs/heads/")
+				}
+			}
+			return line[:40], branch
 		}
+	}
+	return "", ""
+}
 
-		hashi := i + 4
-		hashj := strings.IndexByte(sdata[hashi:j], ' ')
-		if hashj < 0 || hashj != 40 {
-			continue
+// tagRef is a version tag or branch found in a refs advertisement.
+type tagRef struct {
+	hash   string
+	peeled bool
+}
+
+// isBranchRef reports whether name is a maintenance branch of a major
+// version, such as refs/heads/v2.
+func isBranchRef(name string) bool {
+	major := strings.TrimPrefix(name, "refs/heads/v")
+	if major == name || major == "" {
+		return false
+	}
+	for _, c := range major {
+		if c < '0' || c > '9' {
+			return false
 		}
-		hashj += hashi
+	}
+	return true
+}
 
-		namei := hashj + 1
-		namej := strings.IndexAny(sdata[namei:j], "\n\x00")
-		if namej < 0 {
-			namej = j
-		} else {
-			namej += namei
+// refVersion returns the version a tag or vN branch ref stands for.
+func refVersion(name string) (*semver.Version, error) {
+	if isBranchRef(name) {
+		major, err := strconv.ParseInt(strings.TrimPrefix(name, "refs/heads/v"), 10, 64)
+		if err != nil {
+			return nil, err
 		}
+		return branchVersion(major), nil
+	}
+	return semver.NewVersion(strings.TrimPrefix(name, "refs/tags/v"))
+}
+
+// refsScan holds what changeRefs learns from the lines of a refs
+// advertisement.
+type refsScan struct {
+	lightweight bool
 
-		name := sdata[namei:namej]
+	hlinei, hlinej int // HEAD reference line start/end
+	mlinei, mlinej int // master reference line start/end
 
-		if name == "HEAD" {
-			hlinei = i
-			hlinej = j
+	tags     map[string]*tagRef
+	tagNames []string
+}
+
+// scan records the pkt-lines of data. Only the payloads of the lines that
+// may be of interest are copied, so that the many other refs of a large
+// advertisement (e.g.: refs/pull/*) are not held twice.
+func (s *refsScan) scan(data []byte) error {
+	return forEachPktLine(data, func(i, j int, payload []byte) {
+		if relevantRef(payload) {
+			s.line(i, j, string(payload))
 		}
-		if name == "refs/heads/master" {
-			mlinei = i
-			mlinej = j
+	})
+}
+
+// relevantRef reports whether the pkt-line payload may be of interest to
+// refsScan.line.
+func relevantRef(payload []byte) bool {
+	if len(payload) < 41 || payload[40] != ' ' {
+		return false
+	}
+	name := payload[41:]
+	return bytes.HasPrefix(name, []byte("HEAD")) ||
+		bytes.HasPrefix(name, []byte("refs/heads/")) ||
+		bytes.HasPrefix(name, []byte("refs/tags/v"))
+}
+
+// line records the pkt-line found at [i, j) of the advertisement, with the
+// given payload.
+func (s *refsScan) line(i, j int, payload string) {
+	if payload[0] == '#' {
+		return // Comment, such as the service announcement.
+	}
+	if strings.IndexByte(payload, ' ') != 40 {
+		return
+	}
+	name := payload[41:]
+	if n := strings.IndexAny(name, "\n\x00"); n >= 0 {
+		name = name[:n]
+	}
+
+	if name == "HEAD" {
+		s.hlinei = i
+		s.hlinej = j
+	}
+	if name == "refs/heads/master" {
+		s.mlinei = i
+		s.mlinej = j
+	}
+
+	if isBranchRef(name) {
+		if s.tags[name] == nil {
+			s.tags[name] = &tagRef{hash: payload[:40]}
+			s.tagNames = append(s.tagNames, name)
 		}
+		return
+	}
 
-		if strings.HasPrefix(name, "refs/tags/v") {
-			if !strings.HasSuffix(name, "^{}") {
-				continue // Only accept annotated tags.
-			}
-			// Annotated tag is peeled off and overrides the same version just parsed.
-			name = name[:len(name)-3]
-
-			v, err := semver.NewVersion(name[strings.IndexByte(name, 'v')+1:])
-			if err == nil {
-				versions = append(versions, v)
-				if major.Major == v.Major && (vrefv == nil || v == vrefv || vrefv.LessThan(*v)) {
-					vrefv = v
-					vrefhash = sdata[hashi:hashj]
-					vrefname = name
-				}
+	if strings.HasPrefix(name, "refs/tags/v") {
+		peeled := strings.HasSuffix(name, "^{}")
+		if !peeled && !s.lightweight {
+			return // Only accept annotated tags.
+		}
+		// The peeled line holds the commit of an annotated tag. It is
+		// handled on its own, as some advertisements carry it without
+		// the tag line itself.
+		name = strings.TrimSuffix(name, "^{}")
+		hash := payload[:40]
+
+		tag := s.tags[name]
+		if tag == nil {
+			s.tags[name] = &tagRef{hash, peeled}
+			s.tagNames = append(s.tagNames, name)
+		} else if peeled && !tag.peeled || peeled == tag.peeled && hash < tag.hash {
+			tag.hash, tag.peeled = hash, peeled
+		}
+	}
+}
+
+// scanRefs scans the refs advertisement in data.
+func scanRefs(data []byte, lightweight bool) (*refsScan, error) {
+	s := &refsScan{lightweight: lightweight, tags: map[string]*tagRef{}}
+	return s, s.scan(data)
+}
+
+// changeRefs rewrites the refs advertisement in data so HEAD and master point
+// to the best version for which match returns true, and returns all versions
+// found. If match is nil HEAD is kept as advertised. Only annotated tags are
+// considered unless lightweight is set. Branches of a major version (e.g.:
+// refs/heads/v2) are versions too, but tags are preferred over them.
+//
+// When a tag is listed more than once (e.g. after being retagged), the hash is
+// chosen independently of the order of the lines: the peeled commit of an
+// annotated tag wins over a lightweight tag or tag object, and otherwise the
+// lowest hash wins.
+func changeRefs(data []byte, match func(*semver.Version) bool, lightweight bool) (changed []byte, versions semver.Versions, err error) {
+	var vrefhash string
+	var vrefname string
+	var vrefv *semver.Version
+
+	// Record all available versions, the locations of the master and HEAD lines,
+	// and details of the best reference satisfying the requested major version.
+	s, err := scanRefs(data, lightweight)
+	if err != nil {
+		return nil, nil, err
+	}
+	hlinei, hlinej := s.hlinei, s.hlinej
+	mlinei, mlinej := s.mlinei, s.mlinej
+	tags, tagNames := s.tags, s.tagNames
+
+	versions = semver.Versions{}
+	for _, name := range tagNames {
+		v, err := refVersion(name)
+		if err == nil {
+			versions = append(versions, v)
+			if match != nil && match(v) && preferVersion(v, vrefv) {
+				vrefv = v
+				vrefhash = tags[name].hash
+				vrefname = name
 			}
 		}
 	}
 
 	// If the file has no HEAD line or the version was not found, report as unavailable.
-	if hlinei == 0 || vrefhash == "" {
+	if hlinej == 0 || (match != nil && vrefhash == "") {
 		return nil, nil, ErrNoVersion
 	}
+	if match == nil {
+		return data, versions, nil
+	}
 
 	var buf bytes.Buffer
 	buf.Grow(len(data) + 256)
@@ -445,8 +1377,8 @@ func changeRefs(data []byte, major *semver.Version) (changed []byte, versions se
 
 	// Extract the original capabilities.
 	caps := ""
-	if i := strings.Index(sdata[hlinei:hlinej], "\x00"); i > 0 {
-		caps = strings.Replace(sdata[hlinei+i+1:hlinej-1], "symref=", "oldref=", -1)
+	if i := bytes.IndexByte(data[hlinei:hlinej], 0); i > 0 {
+		caps = strings.Replace(string(data[hlinei+i+1:hlinej-1]), "symref=", "oldref=", -1)
 	}
 
 	// Insert the HEAD reference line with the right hash and a proper symref capability.
@@ -471,7 +1403,7 @@ func changeRefs(data []byte, major *semver.Version) (changed []byte, versions se
 	fmt.Fprintf(&buf, "%04x%s", 4+len(line), line)
 
 	// Append the rest, dropping the original master line if necessary.
-	if mlinei > 0 {
+	if mlinej > 0 {
 		buf.Write(data[hlinej:mlinei])
 		buf.Write(data[mlinej:])
 	} else {
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// testHash pads s into a 40 character hash.
+func testHash(s string) string {
+	return strings.Repeat("0", 40-len(s)) + s
+}
+
+// fakeUpstream starts a git host that advertises refs for every repository
+// and returns a RepoRoot pointing at it with https://upper.io as the vanity
+// root.
+func fakeUpstream(t *testing.T, refs string) *RepoRoot {
+	return fakeUpstreamFiles(t, refs, nil)
+}
+
+// fakeUpstreamFiles is like fakeUpstream, but the git host also serves the
+// given files, by path.
+func fakeUpstreamFiles(t *testing.T, refs string, files map[string]string) *RepoRoot {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if data, ok := files[r.URL.Path]; ok {
+			io.WriteString(w, data)
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, ".git/info/refs") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		io.WriteString(w, refs)
+	}))
+	t.Cleanup(srv.Close)
+
+	root, err := NewRepoRoot(srv.URL, "https://upper.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// serve sends a GET request for target to a handler for root.
+func serve(root *RepoRoot, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	resp := httptest.NewRecorder()
+	newHandler(root)(resp, req)
+	return resp
+}
+
+// matchMajor matches versions with the given major.
+func matchMajor(major int64) func(*semver.Version) bool {
+	return func(v *semver.Version) bool { return v.Major == major }
+}
+
+// versionList parses the given versions.
+func versionList(vs ...string) (semver.Versions, error) {
+	var list semver.Versions
+	for _, s := range vs {
+		v, err := semver.NewVersion(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func TestContentLength(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+	))
+
+	tests := []struct {
+		summary string
+		path    string
+		status  int
+	}{
+		{"go-get page", "/db.v1?go-get=1", 200},
+		{"Advertisement", "/db.v1/info/refs?service=git-upload-pack", 200},
+		{"Missing version", "/db.v2?go-get=1", 404},
+		{"Missing go-get parameter", "/db.v1", 404},
+		{"Missing package name", "/", 404},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path)
+		if resp.Code != test.status {
+			t.Fatalf("%s: unexpected status %d", test.summary, resp.Code)
+		}
+		want := strconv.Itoa(resp.Body.Len())
+		if got := resp.Header().Get("Content-Length"); got != want {
+			t.Fatalf("%s: got Content-Length %q, want %q", test.summary, got, want)
+		}
+	}
+}
+
+func TestListenMaxConns(t *testing.T) {
+	li, err := listen("tcp", "127.0.0.1:0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan string, 2)
+	release := make(chan bool)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Path
+		if r.URL.Path == "/first" {
+			<-release
+		}
+	})}
+	srv.SetKeepAlivesEnabled(false)
+	go srv.Serve(li)
+	defer srv.Close()
+
+	done := make(chan error, 2)
+	get := func(path string) {
+		resp, err := http.Get("http://" + li.Addr().String() + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}
+
+	go get("/first")
+	if path := <-started; path != "/first" {
+		t.Fatalf("unexpected request %s", path)
+	}
+
+	go get("/second")
+	select {
+	case path := <-started:
+		t.Fatalf("request %s was served beyond the connection limit", path)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if path := <-started; path != "/second" {
+		t.Fatalf("unexpected request %s", path)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestModuleStyle(t *testing.T) {
+	defer func(s string) { *moduleStyleFlag = s }(*moduleStyleFlag)
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v0.1.0^{}",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+		testHash("4")+" refs/tags/v4.0.0^{}",
+	))
+
+	tests := []struct {
+		style string
+		path  string
+		meta  string
+	}{
+		{gopkgStyle, "/db.v0", "upper.io/db.v0 git https://upper.io/db.v0"},
+		{gopkgStyle, "/db.v1", "upper.io/db.v1 git https://upper.io/db.v1"},
+		{gopkgStyle, "/db.v4", "upper.io/db.v4 git https://upper.io/db.v4"},
+		{modulesStyle, "/db.v0", "upper.io/db git https://upper.io/db.v0"},
+		{modulesStyle, "/db.v1", "upper.io/db git https://upper.io/db.v1"},
+		{modulesStyle, "/db.v4", "upper.io/db/v4 git https://upper.io/db.v4"},
+		{modulesStyle, "/db", "upper.io/db git https://upper.io/db"},
+	}
+
+	for _, test := range tests {
+		*moduleStyleFlag = test.style
+		resp := serve(root, test.path+"?go-get=1")
+		want := `<meta name="go-import" content="` + test.meta + `">`
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Fatalf("%s %s: missing %s in:\n%s", test.style, test.path, want, resp.Body)
+		}
+	}
+}
+
+func TestPinnedVersion(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("1")+" refs/heads/master",
+		testHash("2")+" refs/tags/v4.1.0^{}",
+		testHash("3")+" refs/tags/v4.2.0^{}",
+		testHash("4")+" refs/tags/v4.2.1^{}",
+		testHash("5")+" refs/tags/v4.2.2^{}",
+		testHash("6")+" refs/tags/v4.3.0^{}",
+	))
+
+	tests := []struct {
+		path   string
+		status int
+		head   string
+	}{
+		{"/db.v4", 200, testHash("6")},
+		{"/db.v4.2", 200, testHash("5")},
+		{"/db.v4.2.1", 200, testHash("4")},
+		{"/db.v4.1", 200, testHash("2")},
+		{"/db.v4.4", 404, ""},
+		{"/db.v4.2.9", 404, ""},
+		{"/db.v.2", 404, ""},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path+"/info/refs?service=git-upload-pack")
+		if resp.Code != test.status {
+			t.Fatalf("%s: got status %d, want %d:\n%s", test.path, resp.Code, test.status, resp.Body)
+		}
+		if test.status != 200 {
+			continue
+		}
+		if head, _ := refsHead(resp.Body.Bytes()); head != test.head {
+			t.Fatalf("%s: got HEAD %s, want %s", test.path, head, test.head)
+		}
+	}
+
+	resp := serve(root, "/db.v4.2?go-get=1")
+	want := `<meta name="go-import" content="upper.io/db.v4.2 git https://upper.io/db.v4.2">`
+	if !strings.Contains(resp.Body.String(), want) {
+		t.Fatalf("missing %s in:\n%s", want, resp.Body)
+	}
+}
+
+func TestModulePathVersion(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+		testHash("3")+" refs/tags/v4.0.0^{}",
+		testHash("4")+" refs/tags/v4.1.0^{}",
+	))
+
+	tests := []struct {
+		path string
+		meta string
+	}{
+		{"/db/v4", "upper.io/db/v4 git https://upper.io/db.v4"},
+		{"/db/v4/mongo", "upper.io/db/v4 git https://upper.io/db.v4"},
+		{"/db.v4/mongo", "upper.io/db.v4 git https://upper.io/db.v4"},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path+"?go-get=1")
+		want := `<meta name="go-import" content="` + test.meta + `">`
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Fatalf("%s: missing %s in:\n%s", test.path, want, resp.Body)
+		}
+	}
+
+	resp := serve(root, "/db/v4/info/refs?service=git-upload-pack")
+	if head, _ := refsHead(resp.Body.Bytes()); head != testHash("4") {
+		t.Fatalf("got HEAD %s, want %s", head, testHash("4"))
+	}
+}
+
+func TestSSORequired(t *testing.T) {
+	defer func(v int) { *ssoStatusFlag = v }(*ssoStatusFlag)
+
+	ssoURL := "https://github.com/orgs/upper/sso?authorization_request=abc"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-GitHub-SSO", "required; url="+ssoURL)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	_, _, err := getRefs(srv.URL + "/db" + refsSuffix)
+	if !errors.Is(err, ErrSSORequired) || !strings.Contains(err.Error(), ssoURL) {
+		t.Fatalf("got error %v, want ErrSSORequired with a hint", err)
+	}
+
+	root, err := NewRepoRoot(srv.URL, "https://upper.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []int{http.StatusBadGateway, http.StatusForbidden} {
+		*ssoStatusFlag = status
+		resp := serve(root, "/db.v1?go-get=1")
+		if resp.Code != status {
+			t.Fatalf("got status %d, want %d", resp.Code, status)
+		}
+		if !strings.Contains(resp.Body.String(), "SSO") || !strings.Contains(resp.Body.String(), ssoURL) {
+			t.Fatalf("missing SSO hint in %q", resp.Body)
+		}
+	}
+}
+
+func TestVanityPathModuleMode(t *testing.T) {
+	defer func(s string) { *moduleStyleFlag = s }(*moduleStyleFlag)
+	*moduleStyleFlag = modulesStyle
+
+	root, err := NewRepoRoot("https://github.com/upper", "https://upper.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		major, minor string
+		want         string
+	}{
+		{"", "", "upper.io/db"},
+		{"0", "", "upper.io/db"},
+		{"1", "", "upper.io/db"},
+		{"2", "", "upper.io/db/v2"},
+		{"02", "", "upper.io/db/v2"},
+		{"12", "", "upper.io/db/v12"},
+		{"4", "2", "upper.io/db/v4"},
+		{"1", "2", "upper.io/db"},
+	}
+
+	for _, test := range tests {
+		repo := root.NewRepo("db")
+		repo.Major, repo.Minor = test.major, test.minor
+		repo.RequestedVersion.Major, _ = strconv.ParseInt(test.major, 10, 64)
+		if got := repo.VanityPath(); got != test.want {
+			t.Fatalf("v%s.%s: got %s, want %s", test.major, test.minor, got, test.want)
+		}
+	}
+}
+
+func TestDocsURL(t *testing.T) {
+	defer func(s string) { *docsURLFlag = s }(*docsURLFlag)
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+	))
+	meta := `<meta name="go-import" content="upper.io/db.v1 git https://upper.io/db.v1">`
+
+	*docsURLFlag = ""
+	if resp := serve(root, "/db.v1"); resp.Code != 404 {
+		t.Fatalf("got status %d without -docs-url, want 404", resp.Code)
+	}
+
+	*docsURLFlag = "https://pkg.go.dev/{vanity}"
+
+	resp := serve(root, "/db.v1")
+	if resp.Code != http.StatusFound {
+		t.Fatalf("got status %d for a browser, want 302", resp.Code)
+	}
+	if loc := resp.Header().Get("Location"); loc != "https://pkg.go.dev/upper.io/db.v1" {
+		t.Fatalf("got Location %q", loc)
+	}
+	if !strings.Contains(resp.Body.String(), meta) {
+		t.Fatalf("missing %s in redirect body:\n%s", meta, resp.Body)
+	}
+
+	resp = serve(root, "/db.v1?go-get=1")
+	if resp.Code != 200 || resp.Header().Get("Location") != "" {
+		t.Fatalf("go get request got status %d and Location %q", resp.Code, resp.Header().Get("Location"))
+	}
+	if !strings.Contains(resp.Body.String(), meta) {
+		t.Fatalf("missing %s in:\n%s", meta, resp.Body)
+	}
+}
+
+func TestPrereleases(t *testing.T) {
+	defer func(v bool) { *includePrereleasesFlag = v }(*includePrereleasesFlag)
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v3.2.0^{}",
+		testHash("3")+" refs/tags/v4.0.0-rc1^{}",
+		testHash("4")+" refs/tags/v4.0.0-rc2^{}",
+		testHash("5")+" refs/tags/v5.0.0^{}",
+		testHash("6")+" refs/tags/v5.0.0-beta^{}",
+		testHash("7")+" refs/tags/v5.1.0-rc1^{}",
+	))
+
+	tests := []struct {
+		summary     string
+		prereleases bool
+		path        string
+		head        string
+	}{
+		{"Only pre-releases", false, "/db.v4", ""},
+		{"Only pre-releases with the flag", true, "/db.v4", testHash("4")},
+		{"Mixed", false, "/db.v5", testHash("5")},
+		{"Mixed with the flag", true, "/db.v5", testHash("7")},
+		{"Release wins over its pre-releases", true, "/db.v5.0", testHash("5")},
+	}
+
+	for _, test := range tests {
+		*includePrereleasesFlag = test.prereleases
+		resp := serve(root, test.path+"/info/refs?service=git-upload-pack")
+		if test.head == "" {
+			if resp.Code != 404 {
+				t.Fatalf("%s: got status %d, want 404", test.summary, resp.Code)
+			}
+			continue
+		}
+		if head, _ := refsHead(resp.Body.Bytes()); head != test.head {
+			t.Fatalf("%s: got HEAD %s, want %s", test.summary, head, test.head)
+		}
+	}
+
+	*includePrereleasesFlag = false
+	resp := serve(root, "/db.v5?versions")
+	if !strings.Contains(resp.Body.String(), `"v5.1.0-rc1"`) || !strings.Contains(resp.Body.String(), `"selected":"v5.0.0"`) {
+		t.Fatalf("unexpected versions %s", resp.Body)
+	}
+}
+
+func TestBranchVersions(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/heads/v2",
+		testHash("3")+" refs/tags/v3.0.0^{}",
+		testHash("4")+" refs/heads/v4",
+		testHash("5")+" refs/tags/v4.1.0^{}",
+		testHash("6")+" refs/heads/v5",
+		testHash("7")+" refs/heads/v5-fixes",
+	))
+
+	tests := []struct {
+		summary  string
+		path     string
+		head     string
+		selected string
+	}{
+		{"Branch only", "/db.v2", testHash("2"), "v2"},
+		{"Branch only with a pinned minor", "/db.v2.0", "", ""},
+		{"Tag only", "/db.v3", testHash("3"), "v3.0.0"},
+		{"Tag wins over the branch", "/db.v4", testHash("5"), "v4.1.0"},
+		{"Other branches are ignored", "/db.v5", testHash("6"), "v5"},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path+"/info/refs?service=git-upload-pack")
+		if test.head == "" {
+			if resp.Code != 404 {
+				t.Fatalf("%s: got status %d, want 404", test.summary, resp.Code)
+			}
+			continue
+		}
+		if head, _ := refsHead(resp.Body.Bytes()); head != test.head {
+			t.Fatalf("%s: got HEAD %s, want %s", test.summary, head, test.head)
+		}
+
+		resp = serve(root, test.path+"?versions")
+		if !strings.Contains(resp.Body.String(), `"selected":"`+test.selected+`"`) {
+			t.Fatalf("%s: want %s selected in %s", test.summary, test.selected, resp.Body)
+		}
+	}
+
+	resp := serve(root, "/db.v2?go-get=1")
+	if want := "/tree/v2{/dir} "; !strings.Contains(resp.Body.String(), want) {
+		t.Fatalf("missing %s in:\n%s", want, resp.Body)
+	}
+	resp = serve(root, "/db.v4?versions")
+	if want := `"versions":["v2","v3.0.0","v4","v4.1.0","v5"]`; !strings.Contains(resp.Body.String(), want) {
+		t.Fatalf("missing %s in %s", want, resp.Body)
+	}
+}
+
+func TestSubpackages(t *testing.T) {
+	defer func(s string) { *docsURLFlag = s }(*docsURLFlag)
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v4.1.0^{}",
+	))
+	meta := `<meta name="go-import" content="upper.io/db.v4 git https://upper.io/db.v4">`
+	source := `<meta name="go-source" content="upper.io/db.v4 _ `
+
+	tests := []struct {
+		summary string
+		path    string
+	}{
+		{"Package", ""},
+		{"Subpackage", "/sub/pkg"},
+		{"Deep subpackage", "/a/b/c/d/e/f/g"},
+		{"Subpackage named like a version", "/v2/x.v3"},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, "/db.v4"+test.path+"?go-get=1")
+		if resp.Code != 200 {
+			t.Fatalf("%s: unexpected status %d: %s", test.summary, resp.Code, resp.Body)
+		}
+		body := resp.Body.String()
+		if !strings.Contains(body, meta) || !strings.Contains(body, source) {
+			t.Fatalf("%s: import and source meta are not for the package root:\n%s", test.summary, body)
+		}
+		if want := "go get upper.io/db.v4" + test.path + "\n"; !strings.Contains(body, want) {
+			t.Fatalf("%s: missing %q in:\n%s", test.summary, want, body)
+		}
+	}
+
+	*docsURLFlag = "https://pkg.go.dev/{vanity}"
+	resp := serve(root, "/db.v4/sub/pkg")
+	if loc := resp.Header().Get("Location"); loc != "https://pkg.go.dev/upper.io/db.v4/sub/pkg" {
+		t.Fatalf("got Location %q", loc)
+	}
+
+	for _, path := range []string{"/db.v4x?go-get=1", "/db.v4.1.0.1?go-get=1"} {
+		if resp := serve(root, path); resp.Code != 404 {
+			t.Fatalf("%s: got status %d, want 404", path, resp.Code)
+		}
+	}
+}
+
+func TestRobotsTag(t *testing.T) {
+	defer func(s string) { *robotsTagFlag = s }(*robotsTagFlag)
+	defer func(s string) { *docsURLFlag = s }(*docsURLFlag)
+	*docsURLFlag = "https://pkg.go.dev/{vanity}"
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+	))
+	root.Packages = map[string]*PackageConfig{
+		"public": {RobotsTag: "all"},
+	}
+
+	tests := []struct {
+		summary string
+		flag    string
+		path    string
+		want    string
+	}{
+		{"Not configured", "", "/db.v1?go-get=1", ""},
+		{"go get page", "noindex", "/db.v1?go-get=1", "noindex"},
+		{"Landing page", "noindex", "/db.v1", "noindex"},
+		{"Package setting", "noindex", "/public.v1?go-get=1", "all"},
+		{"Package setting without the flag", "", "/public.v1", "all"},
+		{"Git advertisement", "noindex", "/db.v1/info/refs?service=git-upload-pack", ""},
+		{"Package setting on the git advertisement", "", "/public.v1/info/refs?service=git-upload-pack", ""},
+	}
+
+	for _, test := range tests {
+		*robotsTagFlag = test.flag
+		resp := serve(root, test.path)
+		if resp.Code != 200 && resp.Code != http.StatusFound {
+			t.Fatalf("%s: unexpected status %d: %s", test.summary, resp.Code, resp.Body)
+		}
+		if got := resp.Header().Get("X-Robots-Tag"); got != test.want {
+			t.Fatalf("%s: got X-Robots-Tag %q, want %q", test.summary, got, test.want)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	defer func(addr, domains string) {
+		*addrFlag, *tlsDomainsFlag = addr, domains
+	}(*addrFlag, *tlsDomainsFlag)
+	*addrFlag, *tlsDomainsFlag = "127.0.0.1:0", ""
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v4.1.0^{}",
+	))
+	servers, err := newServers(http.HandlerFunc(newHandler(root)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer servers[0].listener.Close()
+
+	// Paths with a location are redirected to it, with a status that depends
+	// on the Go version.
+	tests := []struct {
+		summary  string
+		path     string
+		status   int
+		location string
+	}{
+		{"Leading double slash", "//db.v4?go-get=1", 0, "/db.v4?go-get=1"},
+		{"Double slash before a subpackage", "/db.v4//mongo?go-get=1", 0, "/db.v4/mongo?go-get=1"},
+		{"Many slashes", "///db.v4///mongo//x?go-get=1", 0, "/db.v4/mongo/x?go-get=1"},
+		{"Git advertisement", "//db.v4//info/refs?service=git-upload-pack", 0, "/db.v4/info/refs?service=git-upload-pack"},
+		{"Only slashes", "//", 0, "/"},
+		{"Clean path", "/db.v4/mongo?go-get=1", 200, ""},
+		{"Backslash separator", `/db.v4\mongo?go-get=1`, 400, ""},
+		{"Leading backslash", `/\db.v4?go-get=1`, 400, ""},
+		{"Escaped backslash", "/db.v4%5Cmongo?go-get=1", 400, ""},
+	}
+
+	for _, test := range tests {
+		resp := httptest.NewRecorder()
+		servers[0].Handler.ServeHTTP(resp, httptest.NewRequest("GET", test.path, nil))
+		if test.location != "" && (resp.Code < 300 || resp.Code >= 400) {
+			t.Fatalf("%s: got status %d, want a redirect: %s", test.summary, resp.Code, resp.Body)
+		}
+		if test.location == "" && resp.Code != test.status {
+			t.Fatalf("%s: got status %d, want %d: %s", test.summary, resp.Code, test.status, resp.Body)
+		}
+		if loc := resp.Header().Get("Location"); loc != test.location {
+			t.Fatalf("%s: got Location %q, want %q", test.summary, loc, test.location)
+		}
+	}
+}
+
+func TestSubpackageMarkup(t *testing.T) {
+	defer func(s string) { *docsURLFlag = s }(*docsURLFlag)
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+	))
+
+	for _, docs := range []string{"", "https://pkg.go.dev/{vanity}"} {
+		*docsURLFlag = docs
+		for _, path := range []string{
+			"/db.v1/%3Cscript%3Ealert(1)%3C/script%3E?go-get=1",
+			"/db.v1/x%22%3E%3Cb%3E?go-get=1",
+			"/db.v1/%3Cscript%3E",
+		} {
+			resp := serve(root, path)
+			if resp.Code != 404 {
+				t.Fatalf("%s: got status %d, want 404", path, resp.Code)
+			}
+			if body := resp.Body.String(); strings.Contains(body, "<") {
+				t.Fatalf("%s: markup in body:\n%s", path, body)
+			}
+			if loc := resp.Header().Get("Location"); loc != "" {
+				t.Fatalf("%s: redirected to %q", path, loc)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsPath is where metrics are served when -metrics is set. Package
+// names cannot contain "_", so it never shadows a package.
+const metricsPath = "/_/metrics"
+
+// Request outcomes counted by vanityMetrics.
+const (
+	outcomeOK         = "ok"
+	outcomeNoRepo     = "no_repo"
+	outcomeNoVersion  = "no_version"
+	outcomeBadGateway = "bad_gateway"
+)
+
+// metrics collects Prometheus metrics when -metrics is set.
+var metrics *vanityMetrics
+
+// vanityMetrics holds the metrics about requests and upstream fetches.
+type vanityMetrics struct {
+	registry *prometheus.Registry
+
+	requests     *prometheus.CounterVec
+	requestTypes *prometheus.CounterVec
+	fetchRefs    prometheus.Histogram
+}
+
+// newMetrics creates the metrics, registered in their own registry.
+func newMetrics() *vanityMetrics {
+	m := &vanityMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vanity_requests_total",
+			Help: "Package requests, by outcome of resolving their version.",
+		}, []string{"outcome"}),
+		requestTypes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vanity_request_types_total",
+			Help: "Package requests, by type: go-get, browser or git.",
+		}, []string{"type"}),
+		fetchRefs: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "vanity_fetch_refs_duration_seconds",
+			Help:    "Latency of fetching refs from the git host.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	m.registry.MustRegister(m.requests, m.requestTypes, m.fetchRefs)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *vanityMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Request counts a package request of the given type. It does nothing on a
+// nil vanityMetrics.
+func (m *vanityMetrics) Request(requestType string) {
+	if m == nil {
+		return
+	}
+	m.requestTypes.WithLabelValues(requestType).Inc()
+}
+
+// Outcome counts the outcome of resolving a package request. It does nothing
+// on a nil vanityMetrics.
+func (m *vanityMetrics) Outcome(outcome string) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(outcome).Inc()
+}
+
+// ObserveFetch records the latency of a refs fetch that began at start. It
+// does nothing on a nil vanityMetrics.
+func (m *vanityMetrics) ObserveFetch(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.fetchRefs.Observe(time.Since(start).Seconds())
+}
+
+// requestType classifies a package request with the given path after the
+// package name as sent by go get, by git or by a browser.
+func requestType(req *http.Request, extra string) string {
+	switch {
+	case req.FormValue("go-get") == "1":
+		return "go-get"
+	case isGitPath(extra):
+		return "git"
+	default:
+		return "browser"
+	}
+}
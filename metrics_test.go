@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	defer func() { metrics = nil }()
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+	))
+
+	if resp := serve(root, metricsPath); strings.Contains(resp.Body.String(), "vanity_requests_total") {
+		t.Fatalf("metrics served without -metrics")
+	}
+
+	metrics = newMetrics()
+	for _, target := range []string{
+		"/db.v1?go-get=1",
+		"/db.v1/info/refs?service=git-upload-pack",
+		"/db.v1",
+		"/db.v2?go-get=1",
+		"/db/v3/info/refs?service=git-upload-pack",
+		"/db.edge/info/refs?service=git-upload-pack",
+	} {
+		serve(root, target)
+	}
+
+	resp := serve(root, metricsPath)
+	if resp.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", resp.Code, resp.Body)
+	}
+	for _, want := range []string{
+		`vanity_requests_total{outcome="ok"} 4`,
+		`vanity_requests_total{outcome="no_version"} 2`,
+		`vanity_request_types_total{type="go-get"} 2`,
+		`vanity_request_types_total{type="git"} 3`,
+		`vanity_request_types_total{type="browser"} 1`,
+		`vanity_fetch_refs_duration_seconds_count 6`,
+	} {
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Fatalf("missing %s in:\n%s", want, resp.Body)
+		}
+	}
+
+	for _, target := range []string{"/metrics?go-get=1", "/metrics.v1?go-get=1"} {
+		if resp := serve(root, target); strings.Contains(resp.Body.String(), "vanity_requests_total") {
+			t.Fatalf("metrics served at package path %s", target)
+		}
+	}
+	resp = serve(root, "/metrics.v1?go-get=1")
+	if !strings.Contains(resp.Body.String(), `content="upper.io/metrics.v1 git`) {
+		t.Fatalf("package named metrics not served:\n%s", resp.Body)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// packagesPath is where the configured packages are listed when
+// -list-packages is set, below the vanity root. Package names cannot contain
+// "_", so it never shadows a package.
+const packagesPath = "/_/packages"
+
+// listPackages returns the import paths of the packages configured for the
+// given roots, sorted, leaving out hidden ones.
+func listPackages(roots []*RepoRoot) []string {
+	list := []string{}
+	for _, root := range roots {
+		for name, cfg := range root.Packages {
+			if cfg != nil && cfg.Hidden {
+				continue
+			}
+			list = append(list, root.NewRepo(name).VanityRoot())
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// servePackages answers with the packages configured for the given roots.
+func servePackages(resp http.ResponseWriter, roots []*RepoRoot) {
+	sendJSON(resp, listPackages(roots))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestListPackages(t *testing.T) {
+	defer func(v bool) { *listPackagesFlag = v }(*listPackagesFlag)
+	*listPackagesFlag = true
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+	))
+	root.Packages = map[string]*PackageConfig{
+		"db":    {},
+		"tools": {Hidden: true},
+	}
+
+	resp := serve(root, packagesPath)
+	if resp.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", resp.Code, resp.Body)
+	}
+	var list []string
+	if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0] != root.NewRepo("db").VanityRoot() {
+		t.Fatalf("got packages %v", list)
+	}
+
+	// A package named packages is still served.
+	if resp := serve(root, "/packages?go-get=1"); strings.HasPrefix(resp.Body.String(), "[") {
+		t.Fatalf("listing served for a package named packages: %s", resp.Body)
+	}
+	resp = serve(root, "/packages.v1?go-get=1")
+	if !strings.Contains(resp.Body.String(), `content="upper.io/packages.v1 git`) {
+		t.Fatalf("package named packages not served: %d\n%s", resp.Code, resp.Body)
+	}
+
+	resp = serve(root, "/tools.v1?go-get=1")
+	if resp.Code != 200 || !strings.Contains(resp.Body.String(), "/tree/1.0.0{/dir} ") {
+		t.Fatalf("hidden package not served: %d\n%s", resp.Code, resp.Body)
+	}
+
+	// With roots, the listing is below each vanity root.
+	defer func() { repoRoots = nil }()
+	var err error
+	repoRoots, err = newRepoRoots(&Config{Roots: []*RootConfig{
+		{VanityRoot: "https://upper.io/internal", RepoRoot: root.repoURL.String()},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = httptest.NewRecorder()
+	newHandler(nil)(resp, httptest.NewRequest("GET", "http://upper.io/internal"+packagesPath, nil))
+	if resp.Code != 200 {
+		t.Fatalf("listing below a vanity root: unexpected status %d: %s", resp.Code, resp.Body)
+	}
+	repoRoots = nil
+
+	*listPackagesFlag = false
+	if resp := serve(root, packagesPath); resp.Code != 404 {
+		t.Fatalf("listing served without -list-packages: %d", resp.Code)
+	}
+}
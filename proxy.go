@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// proxyPrefix is the path under which the GOPROXY protocol is served when
+// -goproxy is set, so GOPROXY=https://upper.io/proxy works for upper.io
+// packages.
+const proxyPrefix = "/proxy/"
+
+// proxyInfo is the JSON body of .info and @latest responses.
+type proxyInfo struct {
+	Version string
+
+	// Recommended is the version of the module recommended by the package
+	// settings, if any.
+	Recommended string `json:",omitempty"`
+}
+
+// serveProxy answers GOPROXY protocol requests for modules under root.
+func serveProxy(resp http.ResponseWriter, req *http.Request, root *RepoRoot) {
+	path := strings.TrimPrefix(req.URL.Path, proxyPrefix)
+	if !strings.HasPrefix(path, root.VanityHostPath+"/") {
+		sendNotFound(resp, "Unknown module path.")
+		return
+	}
+	path = unescapeModulePath(strings.TrimPrefix(path, root.VanityHostPath))
+
+	var modPath, query string
+	if i := strings.Index(path, "/@v/"); i >= 0 {
+		modPath, query = path[:i], path[i+4:]
+	} else if strings.HasSuffix(path, "/@latest") {
+		modPath, query = strings.TrimSuffix(path, "/@latest"), "@latest"
+	} else {
+		sendNotFound(resp, "Unknown proxy request.")
+		return
+	}
+
+	// Responses name the module by the path it was requested with, which
+	// the go command checks, whatever -module-style is.
+	module := root.VanityHostPath + modPath
+
+	p := packagePattern.FindStringSubmatch(modPath)
+	if p == nil || p[4] != "" {
+		sendNotFound(resp, "Unknown module path.")
+		return
+	}
+	repo := root.NewRepo(p[1])
+	repo.Logger = requestLogger(req)
+	repo.Major = p[3]
+	if m := modulePathPattern.FindStringSubmatch(p[6]); p[2] == "" && m != nil && m[2] == "" {
+		repo.Major, repo.ModulePath = m[1], true
+	} else if p[6] != "" {
+		sendNotFound(resp, "Unknown module path.")
+		return
+	}
+	repo.RequestedVersion.Major, _ = strconv.ParseInt(repo.Major, 10, 64)
+
+	original, err := fetchRefs(repo)
+	var versions semver.Versions
+	if err == nil {
+		_, versions, err = changeRefs(original, nil, *allowLightweightTagsFlag)
+	}
+	switch err {
+	case nil:
+	case ErrNoRepo, ErrNoVersion:
+		sendNotFound(resp, "Git repository not found at https://%s", repo.RepoRoot())
+		return
+	default:
+		writeBody(resp, http.StatusBadGateway, []byte(fmt.Sprintf("Cannot obtain refs from Git: %v", err)))
+		return
+	}
+
+	list, err := repo.moduleVersions(versions, original)
+	if err != nil {
+		writeBody(resp, http.StatusBadGateway, []byte(fmt.Sprintf("Cannot obtain go.mod from Git: %v", err)))
+		return
+	}
+	repo.Config.setSunset(resp.Header())
+
+	var recommended string
+	if v := repo.Config.RecommendedVersion(); v != nil && containsString(list, "v"+v.String()) {
+		recommended = "v" + v.String()
+	}
+
+	switch {
+	case query == "list":
+		var body strings.Builder
+		for _, v := range list {
+			body.WriteString(v + "\n")
+		}
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeBody(resp, http.StatusOK, []byte(body.String()))
+	case query == "@latest":
+		if len(list) == 0 {
+			sendNotFound(resp, "No versions found.")
+			return
+		}
+		latest := latestVersion(list)
+		if recommended != "" {
+			latest = recommended
+		}
+		sendJSON(resp, proxyInfo{Version: latest, Recommended: recommended})
+	case strings.HasSuffix(query, ".info"):
+		version := strings.TrimSuffix(query, ".info")
+		if !containsString(list, version) {
+			sendNotFound(resp, "Unknown version %s.", version)
+			return
+		}
+		sendJSON(resp, proxyInfo{Version: version, Recommended: recommended})
+	case strings.HasSuffix(query, ".mod"):
+		version := strings.TrimSuffix(query, ".mod")
+		if !containsString(list, version) {
+			sendNotFound(resp, "Unknown version %s.", version)
+			return
+		}
+		gomod, found, err := fetchFile(repo, strings.TrimSuffix(version, incompatibleSuffix), "go.mod")
+		if err != nil {
+			writeBody(resp, http.StatusBadGateway, []byte(fmt.Sprintf("Cannot obtain go.mod from Git: %v", err)))
+			return
+		}
+		if !found {
+			gomod = []byte(fmt.Sprintf("module %s\n", module))
+		}
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeBody(resp, http.StatusOK, gomod)
+	case strings.HasSuffix(query, ".zip"):
+		version := strings.TrimSuffix(query, ".zip")
+		if !containsString(list, version) {
+			sendNotFound(resp, "Unknown version %s.", version)
+			return
+		}
+		commit, err := versionCommit(original, version)
+		if err != nil {
+			sendNotFound(resp, "Unknown version %s.", version)
+			return
+		}
+		serveModuleZip(resp, repo, module, version, commit)
+	default:
+		sendNotFound(resp, "Unknown proxy request.")
+	}
+}
+
+// incompatibleSuffix marks v2+ versions of a module path without a major
+// suffix, which the go command accepts from repositories that predate modules.
+const incompatibleSuffix = "+incompatible"
+
+// moduleVersions returns, in ascending order, the versions from all that
+// belong to the repository's module path. With -incompatible, v2+ versions
+// that have no go.mod belong to the unversioned module path too, with the
+// +incompatible suffix. Whether they have one is looked up in the
+// repository at the commits the refs advertisement data tags them at.
+func (repo *Repo) moduleVersions(all semver.Versions, data []byte) ([]string, error) {
+	var matches semver.Versions
+	var commits map[string]string
+	incompatible := map[string]bool{}
+	for _, v := range all {
+		switch {
+		case isBranchVersion(v):
+			// Branches have no version the go command accepts.
+		case repo.Major == "" && v.Major <= 1 || repo.Major == fmt.Sprint(v.Major):
+			matches = append(matches, v)
+		case repo.Major == "" && *incompatibleFlag:
+			if _, seen := incompatible[v.String()]; seen {
+				continue
+			}
+			if commits == nil {
+				var err error
+				if commits, err = tagCommits(data); err != nil {
+					return nil, err
+				}
+			}
+			found, err := repo.hasGoMod(v, commits[v.String()])
+			if err != nil {
+				return nil, err
+			}
+			incompatible[v.String()] = !found
+			if !found {
+				matches = append(matches, v)
+			}
+		}
+	}
+	sort.Sort(matches)
+
+	var list []string
+	for _, v := range matches {
+		s := "v" + v.String()
+		if incompatible[v.String()] {
+			s += incompatibleSuffix
+		}
+		if len(list) == 0 || list[len(list)-1] != s {
+			list = append(list, s)
+		}
+	}
+	return list, nil
+}
+
+// tagCommits returns the commits that the version tags in the refs
+// advertisement data point to, by version.
+func tagCommits(data []byte) (map[string]string, error) {
+	s, err := scanRefs(data, *allowLightweightTagsFlag)
+	if err != nil {
+		return nil, err
+	}
+	commits := map[string]string{}
+	for _, name := range s.tagNames {
+		if v, err := refVersion(name); err == nil && !isBranchVersion(v) {
+			commits[v.String()] = s.tags[name].hash
+		}
+	}
+	return commits, nil
+}
+
+// maxGoModCommits bounds the commits whose go.mod presence is kept.
+const maxGoModCommits = 4096
+
+// goModCommits records whether commits have a go.mod, by repository root and
+// commit. The tree of a commit never changes, so unlike refs these are kept
+// whether -cache-ttl is set or not.
+var goModCommits = struct {
+	sync.Mutex
+	found map[string]bool
+}{found: make(map[string]bool)}
+
+// hasGoMod reports whether version v, tagged at commit, has a go.mod, only
+// fetching it the first time commit is asked about.
+func (repo *Repo) hasGoMod(v *semver.Version, commit string) (bool, error) {
+	key := repo.RepoRoot() + "@" + commit
+	goModCommits.Lock()
+	found, ok := goModCommits.found[key]
+	goModCommits.Unlock()
+	if ok && commit != "" {
+		return found, nil
+	}
+
+	_, found, err := fetchFile(repo, "v"+v.String(), "go.mod")
+	if err != nil || commit == "" {
+		return found, err
+	}
+	goModCommits.Lock()
+	defer goModCommits.Unlock()
+	if len(goModCommits.found) >= maxGoModCommits {
+		goModCommits.found = make(map[string]bool)
+	}
+	goModCommits.found[key] = found
+	return found, nil
+}
+
+// latestVersion returns the version @latest answers with from list, in
+// ascending order: the highest release, or the highest pre-release if there
+// is no release. With -include-prereleases, it is the highest version.
+func latestVersion(list []string) string {
+	if !*includePrereleasesFlag {
+		for i := len(list) - 1; i >= 0; i-- {
+			v, err := semver.NewVersion(strings.TrimPrefix(strings.TrimSuffix(list[i], incompatibleSuffix), "v"))
+			if err == nil && v.PreRelease == "" {
+				return list[i]
+			}
+		}
+	}
+	return list[len(list)-1]
+}
+
+// versionCommit returns the commit that version, as listed by
+// moduleVersions, is tagged at in the refs advertisement data.
+func versionCommit(data []byte, version string) (string, error) {
+	want := strings.TrimSuffix(strings.TrimPrefix(version, "v"), incompatibleSuffix)
+	changed, _, err := changeRefs(data, func(v *semver.Version) bool {
+		return v.String() == want
+	}, *allowLightweightTagsFlag)
+	if err != nil {
+		return "", err
+	}
+	commit, _ := refsHead(changed)
+	return commit, nil
+}
+
+// fetchFile fetches a file from the repository at the given ref using the
+// -raw-url template. It reports whether the file exists.
+func fetchFile(repo *Repo, ref string, file string) (data []byte, found bool, err error) {
+	fileURL := strings.NewReplacer(
+		"{repo}", repo.RepoRootURL(),
+		"{ref}", ref,
+		"{file}", file,
+	).Replace(*rawURLFlag)
+
+	resp, err := httpClient.Get(fileURL)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot talk to git repository: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		// ok
+	case 404:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("error from git repository: %v", resp.Status)
+	}
+
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading from git: %v", err)
+	}
+	return data, true, nil
+}
+
+// unescapeModulePath undoes the case encoding of module paths and versions,
+// where "!x" stands for "X".
+func unescapeModulePath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '!' && i+1 < len(s) {
+			i++
+			b.WriteString(strings.ToUpper(s[i : i+1]))
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func sendJSON(resp http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		sendError(resp, "Failed to encode response")
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	writeBody(resp, http.StatusOK, data)
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
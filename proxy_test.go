@@ -0,0 +1,412 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	defer func(v bool) { *goproxyFlag = v }(*goproxyFlag)
+	*goproxyFlag = true
+
+	root := fakeUpstreamFiles(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+		testHash("4")+" refs/tags/v2.0.0",
+		testHash("5")+" refs/tags/v2.0.0^{}",
+		testHash("6")+" refs/tags/v2.1.0",
+		testHash("7")+" refs/tags/v2.1.0^{}",
+	), map[string]string{
+		"/db/raw/v2.1.0/go.mod": "module upper.io/db.v2\n\ngo 1.12\n",
+	})
+
+	tests := []struct {
+		summary string
+		path    string
+		status  int
+		body    string
+	}{{
+		"List versions of a gopkg-style major",
+		"/proxy/upper.io/db.v2/@v/list",
+		200,
+		"v2.0.0\nv2.1.0\n",
+	}, {
+		"List versions of the unversioned module",
+		"/proxy/upper.io/db/@v/list",
+		200,
+		"v1.0.0\n",
+	}, {
+		"Latest version",
+		"/proxy/upper.io/db.v2/@latest",
+		200,
+		`{"Version":"v2.1.0"}`,
+	}, {
+		"Version info",
+		"/proxy/upper.io/db.v2/@v/v2.0.0.info",
+		200,
+		`{"Version":"v2.0.0"}`,
+	}, {
+		"go.mod is returned verbatim",
+		"/proxy/upper.io/db.v2/@v/v2.1.0.mod",
+		200,
+		"module upper.io/db.v2\n\ngo 1.12\n",
+	}, {
+		"Missing go.mod is synthesized",
+		"/proxy/upper.io/db.v2/@v/v2.0.0.mod",
+		200,
+		"module upper.io/db.v2\n",
+	}, {
+		"Version from another major",
+		"/proxy/upper.io/db.v2/@v/v1.0.0.mod",
+		404,
+		"",
+	}, {
+		"List versions of a module-style major",
+		"/proxy/upper.io/db/v2/@v/list",
+		200,
+		"v2.0.0\nv2.1.0\n",
+	}, {
+		"Missing go.mod is synthesized with the module path",
+		"/proxy/upper.io/db/v2/@v/v2.0.0.mod",
+		200,
+		"module upper.io/db/v2\n",
+	}, {
+		"Module path with a subpath",
+		"/proxy/upper.io/db/v2/mongo/@v/list",
+		404,
+		"",
+	}, {
+		"Module from another host",
+		"/proxy/example.org/db/@v/list",
+		404,
+		"",
+	}}
+
+	for _, test := range tests {
+		resp := serve(root, test.path)
+		if resp.Code != test.status {
+			t.Fatalf("%s: unexpected status %d: %s", test.summary, resp.Code, resp.Body)
+		}
+		if test.status == 200 && resp.Body.String() != test.body {
+			t.Fatalf("%s: got body %q, want %q", test.summary, resp.Body, test.body)
+		}
+	}
+}
+
+func TestProxyLatestRelease(t *testing.T) {
+	defer func(v bool) { *goproxyFlag = v }(*goproxyFlag)
+	defer func(v bool) { *includePrereleasesFlag = v }(*includePrereleasesFlag)
+	*goproxyFlag = true
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+		testHash("3")+" refs/tags/v1.1.0-rc1^{}",
+		testHash("4")+" refs/tags/v2.0.0-rc1^{}",
+	))
+
+	tests := []struct {
+		summary     string
+		prereleases bool
+		path        string
+		version     string
+	}{
+		{"Release over a higher pre-release", false, "/proxy/upper.io/db/@latest", "v1.0.0"},
+		{"Pre-release without releases", false, "/proxy/upper.io/db.v2/@latest", "v2.0.0-rc1"},
+		{"Pre-release with -include-prereleases", true, "/proxy/upper.io/db/@latest", "v1.1.0-rc1"},
+	}
+
+	for _, test := range tests {
+		*includePrereleasesFlag = test.prereleases
+		resp := serve(root, test.path)
+		if want := `{"Version":"` + test.version + `"}`; resp.Body.String() != want {
+			t.Fatalf("%s: got %s, want %s", test.summary, resp.Body, want)
+		}
+	}
+}
+
+func TestProxyIncompatible(t *testing.T) {
+	defer func(v bool) { *goproxyFlag = v }(*goproxyFlag)
+	defer func(v bool) { *incompatibleFlag = v }(*incompatibleFlag)
+	*goproxyFlag, *incompatibleFlag = true, true
+
+	root := fakeUpstreamFiles(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+		testHash("3")+" refs/tags/v2.0.0^{}",
+		testHash("4")+" refs/tags/v3.0.0^{}",
+	), map[string]string{
+		"/db/raw/v3.0.0/go.mod": "module upper.io/db/v3\n",
+	})
+
+	tests := []struct {
+		summary string
+		path    string
+		body    string
+	}{{
+		"A v2 tag without go.mod is listed as +incompatible",
+		"/proxy/upper.io/db/@v/list",
+		"v1.0.0\nv2.0.0+incompatible\n",
+	}, {
+		"Latest version",
+		"/proxy/upper.io/db/@latest",
+		`{"Version":"v2.0.0+incompatible"}`,
+	}, {
+		"Version info",
+		"/proxy/upper.io/db/@v/v2.0.0+incompatible.info",
+		`{"Version":"v2.0.0+incompatible"}`,
+	}, {
+		"go.mod of the unversioned module path",
+		"/proxy/upper.io/db/@v/v2.0.0+incompatible.mod",
+		"module upper.io/db\n",
+	}, {
+		"Versioned module paths are not affected",
+		"/proxy/upper.io/db.v2/@v/list",
+		"v2.0.0\n",
+	}}
+
+	for _, test := range tests {
+		resp := serve(root, test.path)
+		if resp.Code != 200 {
+			t.Fatalf("%s: unexpected status %d: %s", test.summary, resp.Code, resp.Body)
+		}
+		if resp.Body.String() != test.body {
+			t.Fatalf("%s: got body %q, want %q", test.summary, resp.Body, test.body)
+		}
+	}
+
+	if resp := serve(root, "/proxy/upper.io/db/@v/v3.0.0+incompatible.info"); resp.Code != 404 {
+		t.Fatalf("v3.0.0 has a go.mod but got status %d", resp.Code)
+	}
+}
+
+func TestProxyIncompatibleRemembersGoMod(t *testing.T) {
+	defer func(v bool) { *goproxyFlag = v }(*goproxyFlag)
+	defer func(v bool) { *incompatibleFlag = v }(*incompatibleFlag)
+	defer func(s string) { *rawURLFlag = s }(*rawURLFlag)
+	*goproxyFlag, *incompatibleFlag = true, true
+
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if r.URL.Path == "/v3.0.0/go.mod" {
+			io.WriteString(w, "module upper.io/db/v3\n")
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	*rawURLFlag = srv.URL + "/{ref}/{file}"
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+		testHash("3")+" refs/tags/v2.0.0^{}",
+		testHash("4")+" refs/tags/v3.0.0^{}",
+	))
+
+	for i, want := range []int32{2, 0} {
+		atomic.StoreInt32(&fetches, 0)
+		resp := serve(root, "/proxy/upper.io/db/@v/list")
+		if resp.Body.String() != "v1.0.0\nv2.0.0+incompatible\n" {
+			t.Fatalf("request %d: unexpected list %q", i, resp.Body)
+		}
+		if got := atomic.LoadInt32(&fetches); got != want {
+			t.Fatalf("request %d: got %d go.mod fetches, want %d", i, got, want)
+		}
+	}
+}
+
+// tarGz returns a tar.gz archive holding the given files, by name, plus a
+// symlink and the global header GitHub archives start with.
+func tarGz(t *testing.T, files map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "commit"}},
+		{Typeflag: tar.TypeSymlink, Name: "db-commit/link", Linkname: "go.mod"},
+	}
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(files[name]))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestProxyZip(t *testing.T) {
+	defer func(v bool) { *goproxyFlag = v }(*goproxyFlag)
+	*goproxyFlag = true
+
+	root := fakeUpstreamFiles(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v2.0.0",
+		testHash("3")+" refs/tags/v2.0.0^{}",
+	), map[string]string{
+		"/db/archive/" + testHash("3") + ".tar.gz": tarGz(t, map[string]string{
+			"db-commit/go.mod":     "module upper.io/db.v2\n",
+			"db-commit/db.go":      "package db\n",
+			"db-commit/mongo/m.go": "package mongo\n",
+
+			"db-commit/vendor/modules.txt":        "# example.org/x v1.0.0\n",
+			"db-commit/vendor/example.org/x/x.go": "package x\n",
+			"db-commit/internal/vendor/y/y.go":    "package y\n",
+			"db-commit/tools/go.mod":              "module upper.io/db.v2/tools\n",
+			"db-commit/tools/gen/main.go":         "package main\n",
+			"db-commit/.hg_archival.txt":          "repo: commit\n",
+		}),
+	})
+
+	resp := serve(root, "/proxy/upper.io/db.v2/@v/v2.0.0.zip")
+	if resp.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", resp.Code, resp.Body)
+	}
+	if ct := resp.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Fatalf("got Content-Type %q", ct)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"upper.io/db.v2@v2.0.0/db.go":      "package db\n",
+		"upper.io/db.v2@v2.0.0/go.mod":     "module upper.io/db.v2\n",
+		"upper.io/db.v2@v2.0.0/mongo/m.go": "package mongo\n",
+
+		"upper.io/db.v2@v2.0.0/vendor/modules.txt": "# example.org/x v1.0.0\n",
+	}
+	if len(zr.File) != len(want) {
+		t.Fatalf("got %d files, want %d", len(zr.File), len(want))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, ok := want[f.Name]; !ok || string(data) != content {
+			t.Fatalf("unexpected file %s with %q", f.Name, data)
+		}
+	}
+
+	if resp := serve(root, "/proxy/upper.io/db.v2/@v/v2.9.0.zip"); resp.Code != 404 {
+		t.Fatalf("unknown version got status %d", resp.Code)
+	}
+}
+
+func TestProxyRequestedModulePath(t *testing.T) {
+	defer func(v bool) { *goproxyFlag = v }(*goproxyFlag)
+	defer func(s string) { *moduleStyleFlag = s }(*moduleStyleFlag)
+	*goproxyFlag = true
+
+	root := fakeUpstreamFiles(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v2.0.0^{}",
+	), map[string]string{
+		"/db/archive/" + testHash("2") + ".tar.gz": tarGz(t, map[string]string{
+			"db-commit/db.go": "package db\n",
+		}),
+	})
+
+	for _, style := range []string{gopkgStyle, modulesStyle} {
+		*moduleStyleFlag = style
+		for _, module := range []string{"upper.io/db.v2", "upper.io/db/v2"} {
+			resp := serve(root, "/proxy/"+module+"/@v/v2.0.0.mod")
+			if want := "module " + module + "\n"; resp.Body.String() != want {
+				t.Fatalf("%s style: got go.mod %q, want %q", style, resp.Body, want)
+			}
+
+			resp = serve(root, "/proxy/"+module+"/@v/v2.0.0.zip")
+			zr, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+			if err != nil {
+				t.Fatalf("%s style: %v: %s", style, err, resp.Body)
+			}
+			if want := module + "@v2.0.0/db.go"; len(zr.File) != 1 || zr.File[0].Name != want {
+				t.Fatalf("%s style: got zip files %v, want %s", style, zr.File, want)
+			}
+		}
+	}
+}
+
+func TestModuleFiles(t *testing.T) {
+	include, err := moduleFiles([]archiveFile{
+		{"go.mod", 10},
+		{"db.go", 10},
+		{"vendor/modules.txt", 10},
+		{"vendor/example.org/x/x.go", 10},
+		{"a/vendor/b/c.go", 10},
+		{"a/vendor/b.go", 10},
+		{"nested/go.mod", 10},
+		{"nested/deep/n.go", 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for name := range include {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	if want := "db.go go.mod vendor/modules.txt"; strings.Join(got, " ") != want {
+		t.Fatalf("got files %v, want %s", got, want)
+	}
+
+	for _, files := range [][]archiveFile{
+		{{"Db.go", 1}, {"db.go", 1}},
+		{{"db", 1}, {"DB/x.go", 1}},
+		{{"a/../b.go", 1}},
+		{{"db.go.", 1}},
+		{{"con.go", 1}},
+		{{"a:b.go", 1}},
+		{{"GO.MOD", 1}},
+		{{"go.mod", maxGoModSize + 1}},
+		{{"a.go", maxModuleZipSize}, {"b.go", 1}},
+	} {
+		if _, err := moduleFiles(files); err == nil {
+			t.Fatalf("accepted files %v", files)
+		}
+	}
+}
+
+func TestUnescapeModulePath(t *testing.T) {
+	if got := unescapeModulePath("github.com/!burnt!sushi/toml"); got != "github.com/BurntSushi/toml" {
+		t.Fatalf("unexpected path %q", got)
+	}
+}
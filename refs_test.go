@@ -5,6 +5,8 @@ import (
 	"fmt"
 	. "gopkg.in/check.v1"
 	"sort"
+	"strings"
+	"testing"
 
 	"github.com/coreos/go-semver/semver"
 )
@@ -180,7 +182,7 @@ func (s *RefsSuite) TestChangeRefs(c *C) {
 			c.Fatalf("Test has an invalid version: %q: %v", test.version, err)
 		}
 
-		changed, versions, err := changeRefs([]byte(test.original), v)
+		changed, versions, err := changeRefs([]byte(test.original), matchMajor(v.Major), false)
 		c.Assert(err, IsNil)
 
 		c.Assert(string(changed), Equals, test.changed)
@@ -194,3 +196,316 @@ func (s *RefsSuite) TestChangeRefs(c *C) {
 		c.Assert(vs, DeepEquals, test.versions)
 	}
 }
+
+func TestChangeRefsPeeledOnly(t *testing.T) {
+	original := reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/heads/master",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+		testHash("4")+" refs/tags/v1.1.0^{}",
+		testHash("5")+" refs/tags/v2.0.0^{}",
+	)
+
+	changed, versions, err := changeRefs([]byte(original), matchMajor(1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Sort(versions)
+	var vs []string
+	for _, v := range versions {
+		vs = append(vs, v.String())
+	}
+	if got := strings.Join(vs, " "); got != "1.0.0 1.1.0 2.0.0" {
+		t.Fatalf("unexpected versions %s", got)
+	}
+
+	if head, _ := refsHead(changed); head != testHash("4") {
+		t.Fatalf("HEAD points to %s, want %s", head, testHash("4"))
+	}
+}
+
+func TestChangeRefsLightweightTags(t *testing.T) {
+	tests := []struct {
+		summary     string
+		lightweight bool
+		lines       []string
+		head        string
+		versions    string
+		err         error
+	}{{
+		"Lightweight tags are ignored by default",
+		false,
+		[]string{
+			testHash("1") + " HEAD",
+			testHash("2") + " refs/tags/v1.0.0",
+			testHash("3") + " refs/tags/v1.1.0",
+		},
+		"",
+		"",
+		ErrNoVersion,
+	}, {
+		"Lightweight tags only",
+		true,
+		[]string{
+			testHash("1") + " HEAD",
+			testHash("2") + " refs/tags/v1.0.0",
+			testHash("3") + " refs/tags/v1.1.0",
+		},
+		testHash("3"),
+		"1.0.0 1.1.0",
+		nil,
+	}, {
+		"Annotated tags only",
+		true,
+		[]string{
+			testHash("1") + " HEAD",
+			testHash("2") + " refs/tags/v1.0.0",
+			testHash("3") + " refs/tags/v1.0.0^{}",
+			testHash("4") + " refs/tags/v1.1.0",
+			testHash("5") + " refs/tags/v1.1.0^{}",
+		},
+		testHash("5"),
+		"1.0.0 1.1.0",
+		nil,
+	}, {
+		"Mixed tags, newest is lightweight",
+		true,
+		[]string{
+			testHash("1") + " HEAD",
+			testHash("2") + " refs/tags/v1.0.0",
+			testHash("3") + " refs/tags/v1.0.0^{}",
+			testHash("4") + " refs/tags/v1.1.0",
+		},
+		testHash("4"),
+		"1.0.0 1.1.0",
+		nil,
+	}, {
+		"Mixed tags, newest is annotated",
+		true,
+		[]string{
+			testHash("1") + " HEAD",
+			testHash("2") + " refs/tags/v1.0.0",
+			testHash("3") + " refs/tags/v1.1.0",
+			testHash("4") + " refs/tags/v1.1.0^{}",
+		},
+		testHash("4"),
+		"1.0.0 1.1.0",
+		nil,
+	}, {
+		"Peeled commit wins even when listed before the tag",
+		true,
+		[]string{
+			testHash("1") + " HEAD",
+			testHash("3") + " refs/tags/v1.1.0^{}",
+			testHash("2") + " refs/tags/v1.1.0",
+		},
+		testHash("3"),
+		"1.1.0",
+		nil,
+	}}
+
+	for _, test := range tests {
+		changed, versions, err := changeRefs([]byte(reflines(test.lines...)), matchMajor(1), test.lightweight)
+		if err != test.err {
+			t.Fatalf("%s: got error %v, want %v", test.summary, err, test.err)
+		}
+		if err != nil {
+			continue
+		}
+
+		if head, _ := refsHead(changed); head != test.head {
+			t.Fatalf("%s: HEAD points to %s, want %s", test.summary, head, test.head)
+		}
+
+		sort.Sort(versions)
+		var vs []string
+		for _, v := range versions {
+			vs = append(vs, v.String())
+		}
+		if got := strings.Join(vs, " "); got != test.versions {
+			t.Fatalf("%s: got versions %q, want %q", test.summary, got, test.versions)
+		}
+	}
+}
+
+func TestChangeRefsConflictingTags(t *testing.T) {
+	tests := []struct {
+		summary string
+		lines   []string
+		head    string
+	}{{
+		"Annotated tag wins over a lightweight tag",
+		[]string{
+			testHash("b") + " refs/tags/v2.3.0",
+			testHash("a") + " refs/tags/v2.3.0",
+			testHash("c") + " refs/tags/v2.3.0^{}",
+		},
+		testHash("c"),
+	}, {
+		"Lowest hash wins among lightweight tags",
+		[]string{
+			testHash("b") + " refs/tags/v2.3.0",
+			testHash("a") + " refs/tags/v2.3.0",
+		},
+		testHash("a"),
+	}, {
+		"Lowest hash wins among annotated tags",
+		[]string{
+			testHash("d") + " refs/tags/v2.3.0^{}",
+			testHash("c") + " refs/tags/v2.3.0^{}",
+			testHash("a") + " refs/tags/v2.3.0",
+		},
+		testHash("c"),
+	}}
+
+	for _, test := range tests {
+		// Every rotation of the lines must resolve to the same commit.
+		for i := range test.lines {
+			lines := append([]string{testHash("1") + " HEAD"}, test.lines[i:]...)
+			lines = append(lines, test.lines[:i]...)
+
+			changed, versions, err := changeRefs([]byte(reflines(lines...)), matchMajor(2), true)
+			if err != nil {
+				t.Fatalf("%s: %v", test.summary, err)
+			}
+			if head, _ := refsHead(changed); head != test.head {
+				t.Fatalf("%s: rotation %d: HEAD points to %s, want %s", test.summary, i, head, test.head)
+			}
+			if len(versions) != 1 {
+				t.Fatalf("%s: got %d versions, want 1", test.summary, len(versions))
+			}
+		}
+	}
+}
+
+func TestChangeRefsEqualPrecedence(t *testing.T) {
+	lines := []string{
+		testHash("a") + " refs/tags/v2.3.0+build.1^{}",
+		testHash("b") + " refs/tags/v2.3.0+build.2^{}",
+		testHash("c") + " refs/tags/v2.3.0^{}",
+		testHash("d") + " refs/tags/v2.2.0+build.9^{}",
+	}
+
+	// Every rotation of the lines must resolve to the same tag, in both
+	// changeRefs and SetVersions.
+	for i := range lines {
+		rotated := append([]string{testHash("1") + " HEAD"}, lines[i:]...)
+		rotated = append(rotated, lines[:i]...)
+
+		changed, versions, err := changeRefs([]byte(reflines(rotated...)), matchMajor(2), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head, _ := refsHead(changed); head != testHash("b") {
+			t.Fatalf("rotation %d: HEAD points to %s, want %s", i, head, testHash("b"))
+		}
+
+		repo := &Repo{Major: "2", RequestedVersion: semver.Version{Major: 2}}
+		repo.SetVersions(versions)
+		if got := repo.ResolvedVersionString(); got != "v2.3.0+build.2" {
+			t.Fatalf("rotation %d: SetVersions selected %s, want v2.3.0+build.2", i, got)
+		}
+	}
+}
+
+func TestChangeRefsCommentLines(t *testing.T) {
+	pkt := func(line string) string {
+		return fmt.Sprintf("%04x%s\n", len(line)+5, line)
+	}
+
+	// The comment comes after other pkt-lines and looks like a HEAD line.
+	comment := "#" + strings.Repeat("x", 39) + " HEAD"
+	data := pkt(testHash("1")+" HEAD\x00symref=HEAD:refs/heads/master") +
+		pkt(comment) +
+		pkt(testHash("1")+" refs/heads/master") +
+		"0001" +
+		pkt(testHash("2")+" refs/tags/v1.0.0^{}") +
+		"0000"
+
+	changed, versions, err := changeRefs([]byte(data), matchMajor(1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("got %d versions, want 1", len(versions))
+	}
+
+	lines, err := pktLines(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var heads []string
+	for _, line := range lines {
+		if len(line) > 41 && line[0] != '#' && strings.TrimRight(line[41:], "\n")[:4] == "HEAD" {
+			heads = append(heads, line[:40])
+		}
+	}
+	if len(heads) != 1 || heads[0] != testHash("2") {
+		t.Fatalf("got HEAD lines %q, want one pointing to %s", heads, testHash("2"))
+	}
+	if !strings.Contains(string(changed), comment) {
+		t.Fatalf("comment line was dropped:\n%q", changed)
+	}
+
+	for _, truncated := range []string{data[:len(data)-2], data[:10]} {
+		if _, _, err := changeRefs([]byte(truncated), matchMajor(1), false); err == nil {
+			t.Fatalf("accepted truncated refs %q", truncated)
+		}
+	}
+}
+
+// largeRefs returns an advertisement with n annotated tags spread over a few
+// major versions and, as in monorepos, many more pull request refs, plus the
+// comment and flush lines of a real one.
+func largeRefs(n int) []byte {
+	var buf bytes.Buffer
+	writePktLine(&buf, "# service=git-upload-pack\n")
+	buf.WriteString("0000")
+	writePktLine(&buf, testHash("1")+" HEAD\x00multi_ack symref=HEAD:refs/heads/master\n")
+	writePktLine(&buf, testHash("1")+" refs/heads/master\n")
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("refs/tags/v%d.%d.%d", i%4, i/100, i%100)
+		writePktLine(&buf, testHash(fmt.Sprintf("%x", 2*i))+" "+name+"\n")
+		writePktLine(&buf, testHash(fmt.Sprintf("%x", 2*i+1))+" "+name+"^{}\n")
+		for j := 0; j < 4; j++ {
+			writePktLine(&buf, testHash(fmt.Sprintf("%x", i))+fmt.Sprintf(" refs/pull/%d/head\n", 4*i+j))
+		}
+	}
+	buf.WriteString("0000")
+	return buf.Bytes()
+}
+
+func TestChangeRefsLarge(t *testing.T) {
+	data := largeRefs(1000)
+	for major := int64(0); major < 4; major++ {
+		changed, versions, err := changeRefs(data, matchMajor(major), false)
+		if err != nil {
+			t.Fatalf("v%d: %v", major, err)
+		}
+		if len(versions) != 1000 {
+			t.Fatalf("v%d: got %d versions, want 1000", major, len(versions))
+		}
+		if !bytes.HasSuffix(changed, data[len(data)-100:]) {
+			t.Fatalf("v%d: the refs after HEAD were not kept", major)
+		}
+	}
+
+	for _, truncated := range [][]byte{data[:len(data)-7], data[:2], []byte("zzzz")} {
+		if _, _, err := changeRefs(truncated, matchMajor(1), false); err == nil {
+			t.Fatalf("accepted broken refs %q", truncated)
+		}
+	}
+}
+
+func BenchmarkChangeRefs(b *testing.B) {
+	data := largeRefs(50000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := changeRefs(data, matchMajor(2), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
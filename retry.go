@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+var (
+	fetchRetriesFlag = flag.Int("fetch-retries", 2, "Number of times a refs request is retried after a network error or a 5xx response")
+	fetchBackoffFlag = flag.Duration("fetch-backoff", 200*time.Millisecond, "Wait before the first refs request retry, doubled on each further retry")
+)
+
+// getWithRetries sends a GET request for target with do, retrying up to
+// -fetch-retries times on network errors and 5xx responses. Retries back off
+// exponentially, with jitter, and stop once the next attempt would start past
+// the httpClient timeout. Any other response, as a 404, is returned as is.
+func getWithRetries(target string, do func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	var deadline time.Time
+	if httpClient.Timeout > 0 {
+		deadline = time.Now().Add(httpClient.Timeout)
+	}
+
+	backoff := *fetchBackoffFlag
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := do(req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if attempt >= *fetchRetriesFlag {
+			return resp, err
+		}
+
+		wait := backoff
+		if backoff > 0 {
+			wait = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		}
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
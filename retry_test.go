@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetWithRetries(t *testing.T) {
+	defer func(v time.Duration) { *fetchBackoffFlag = v }(*fetchBackoffFlag)
+	*fetchBackoffFlag = time.Millisecond
+
+	var calls int
+	flaky := func(req *http.Request) (*http.Response, error) {
+		calls++
+		switch calls {
+		case 1:
+			return nil, errors.New("connection reset by peer")
+		case 2:
+			rec := httptest.NewRecorder()
+			rec.WriteHeader(http.StatusServiceUnavailable)
+			return rec.Result(), nil
+		}
+		rec := httptest.NewRecorder()
+		io.WriteString(rec, "ok")
+		return rec.Result(), nil
+	}
+
+	resp, err := getWithRetries("http://example.org/db.git/info/refs", flaky)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || calls != 3 {
+		t.Fatalf("got status %d after %d calls", resp.StatusCode, calls)
+	}
+
+	defer func(v int) { *fetchRetriesFlag = v }(*fetchRetriesFlag)
+	*fetchRetriesFlag = 0
+	calls = 0
+	_, err = getWithRetries("http://example.org/db.git/info/refs", flaky)
+	if err == nil || calls != 1 {
+		t.Fatalf("got %v after %d calls with -fetch-retries 0", err, calls)
+	}
+}
+
+func TestFetchRetriesNotFound(t *testing.T) {
+	defer func(v time.Duration) { *fetchBackoffFlag = v }(*fetchBackoffFlag)
+	*fetchBackoffFlag = time.Millisecond
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	_, _, err := getRefs(srv.URL + "/db" + refsSuffix)
+	if err != ErrNoRepo {
+		t.Fatalf("got error %v, want %v", err, ErrNoRepo)
+	}
+	if calls != 1 {
+		t.Fatalf("404 was requested %d times", calls)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// repoRoots holds the repository roots from -config, if it lists any. The
+// handler then picks the root for each request by its host and path instead
+// of using the one from -repo-root and -vanity-root.
+var repoRoots []*RepoRoot
+
+// newRepoRoots creates the repository roots listed in cfg.
+func newRepoRoots(cfg *Config) ([]*RepoRoot, error) {
+	var roots []*RepoRoot
+	for i, rc := range cfg.Roots {
+		if rc.VanityRoot == "" || rc.RepoRoot == "" {
+			return nil, fmt.Errorf("root %d must have a vanity_root and a repo_root", i)
+		}
+		root, err := NewRepoRoot(rc.RepoRoot, rc.VanityRoot)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse root %d: %v", i, err)
+		}
+		root.VanityHostPath = strings.TrimSuffix(strings.ToLower(root.VanityHostPath), "/")
+		root.Packages = rc.Packages
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// matchHostRoot is matchRoot for a request to host and path. A host with a
+// port (e.g.: upper.io:8080) also matches roots whose vanity root has none.
+func matchHostRoot(roots []*RepoRoot, host, path string) (root *RepoRoot, rest string) {
+	if root, rest = matchRoot(roots, host+path); root != nil {
+		return root, rest
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return matchRoot(roots, h+path)
+	}
+	return nil, ""
+}
+
+// matchRoot returns the root whose vanity host and path is the longest prefix
+// of hostPath, ending at a path boundary, and the rest of hostPath after it.
+// It returns a nil root if none matches.
+func matchRoot(roots []*RepoRoot, hostPath string) (root *RepoRoot, rest string) {
+	for _, r := range roots {
+		prefix := r.VanityHostPath
+		if !strings.HasPrefix(hostPath, prefix) {
+			continue
+		}
+		if len(hostPath) > len(prefix) && hostPath[len(prefix)] != '/' {
+			continue
+		}
+		if root == nil || len(prefix) > len(root.VanityHostPath) {
+			root, rest = r, hostPath[len(prefix):]
+		}
+	}
+	return root, rest
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMatchRoot(t *testing.T) {
+	roots, err := newRepoRoots(&Config{Roots: []*RootConfig{
+		{VanityRoot: "https://upper.io", RepoRoot: "https://github.com/upper"},
+		{VanityRoot: "https://upper.io/internal", RepoRoot: "https://git.example.org/upper"},
+		{VanityRoot: "https://Example.org/", RepoRoot: "https://github.com/example"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		summary  string
+		hostPath string
+		root     string
+		rest     string
+	}{
+		{"Host only root", "upper.io/db.v4", "github.com/upper", "/db.v4"},
+		{"Longest prefix wins", "upper.io/internal/db.v4", "git.example.org/upper", "/db.v4"},
+		{"Prefix must end at a path boundary", "upper.io/internals/db", "github.com/upper", "/internals/db"},
+		{"Root itself", "upper.io/internal", "git.example.org/upper", ""},
+		{"Vanity roots are case insensitive", "example.org/pkg", "github.com/example", "/pkg"},
+		{"Other host", "upper.com/db", "", ""},
+		{"Host prefix is not a match", "upper.io.example.com/db", "", ""},
+	}
+
+	for _, test := range tests {
+		root, rest := matchRoot(roots, test.hostPath)
+		if root == nil {
+			if test.root != "" {
+				t.Fatalf("%s: no root matched", test.summary)
+			}
+			continue
+		}
+		if root.RepoHostPath != test.root || rest != test.rest {
+			t.Fatalf("%s: got %s and %q, want %s and %q", test.summary, root.RepoHostPath, rest, test.root, test.rest)
+		}
+	}
+
+	if _, err := newRepoRoots(&Config{Roots: []*RootConfig{{VanityRoot: "https://upper.io"}}}); err == nil {
+		t.Fatalf("accepted a root without repo_root")
+	}
+}
+
+func TestMultipleRoots(t *testing.T) {
+	defer func() { repoRoots = nil }()
+
+	public := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+	))
+	internal := fakeUpstream(t, reflines(
+		testHash("3")+" HEAD",
+		testHash("4")+" refs/tags/v1.0.0^{}",
+	))
+
+	var err error
+	repoRoots, err = newRepoRoots(&Config{Roots: []*RootConfig{
+		{VanityRoot: "https://upper.io", RepoRoot: public.repoURL.String()},
+		{VanityRoot: "https://upper.io/internal", RepoRoot: internal.repoURL.String()},
+		{VanityRoot: "https://example.org", RepoRoot: internal.repoURL.String()},
+		{VanityRoot: "https://localhost:8080", RepoRoot: public.repoURL.String()},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		status int
+		head   string
+		meta   string
+	}{
+		{"http://upper.io/db.v1", 200, testHash("2"), "upper.io/db.v1 git https://upper.io/db.v1"},
+		{"http://upper.io/internal/db.v1", 200, testHash("4"), "upper.io/internal/db.v1 git https://upper.io/internal/db.v1"},
+		{"http://example.org/db.v1", 200, testHash("4"), "example.org/db.v1 git https://example.org/db.v1"},
+		{"http://unknown.org/db.v1", 404, "", ""},
+		{"http://upper.io.example.com/db.v1", 404, "", ""},
+		{"http://upper.io:8080/db.v1", 200, testHash("2"), "upper.io/db.v1 git https://upper.io/db.v1"},
+		{"http://localhost:8080/db.v1", 200, testHash("2"), "localhost:8080/db.v1 git https://localhost:8080/db.v1"},
+		{"http://example.org:8080/db.v1", 200, testHash("4"), "example.org/db.v1 git https://example.org/db.v1"},
+		{"http://localhost:9090/db.v1", 404, "", ""},
+	}
+
+	for _, test := range tests {
+		resp := httptest.NewRecorder()
+		newHandler(nil)(resp, httptest.NewRequest("GET", test.target+"/info/refs?service=git-upload-pack", nil))
+		if resp.Code != test.status {
+			t.Fatalf("%s: got status %d, want %d: %s", test.target, resp.Code, test.status, resp.Body)
+		}
+		if test.status != 200 {
+			continue
+		}
+		if head, _ := refsHead(resp.Body.Bytes()); head != test.head {
+			t.Fatalf("%s: got HEAD %s, want %s", test.target, head, test.head)
+		}
+
+		resp = httptest.NewRecorder()
+		newHandler(nil)(resp, httptest.NewRequest("GET", test.target+"?go-get=1", nil))
+		want := `<meta name="go-import" content="` + test.meta + `">`
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Fatalf("%s: missing %s in:\n%s", test.target, want, resp.Body)
+		}
+	}
+}
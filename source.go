@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sourceTemplate holds the URL patterns of the go-source meta tag, for
+// directories and files. Besides the {/dir}, {file} and {line} placeholders
+// the go command fills in, they may use {root} for the source root URL and
+// {ref} for the branch or tag.
+type sourceTemplate struct {
+	Dir  string
+	File string
+}
+
+// sourceTemplates are the layouts of common git hosts, by name.
+var sourceTemplates = map[string]sourceTemplate{
+	"github": {
+		Dir:  "{root}/tree/{ref}{/dir}",
+		File: "{root}/blob/{ref}{/dir}/{file}#L{line}",
+	},
+	"gitlab": {
+		Dir:  "{root}/-/tree/{ref}{/dir}",
+		File: "{root}/-/blob/{ref}{/dir}/{file}#L{line}",
+	},
+	"gitea": {
+		Dir:  "{root}/src/{ref}{/dir}",
+		File: "{root}/src/{ref}{/dir}/{file}#L{line}",
+	},
+}
+
+// source is the layout of source links, from -source-template.
+var source = sourceTemplates["github"]
+
+// parseSourceTemplate parses the name of a known layout, or a directory and
+// a file pattern separated by a space.
+func parseSourceTemplate(s string) (sourceTemplate, error) {
+	if t, ok := sourceTemplates[s]; ok {
+		return t, nil
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return sourceTemplate{}, fmt.Errorf("%q is not a known layout nor a pair of directory and file URL patterns", s)
+	}
+	return sourceTemplate{Dir: fields[0], File: fields[1]}, nil
+}
+
+// sourceRef is what a sourceTemplate is expanded with.
+type sourceRef struct {
+	// Root is the URL of the repository's source (e.g.:
+	// https://github.com/upper/db).
+	Root string
+
+	// Ref is the branch or tag the links point to.
+	Ref string
+}
+
+// Expand returns the patterns with the {root} and {ref} placeholders
+// replaced.
+func (t sourceTemplate) Expand(ref sourceRef) sourceTemplate {
+	r := strings.NewReplacer("{root}", ref.Root, "{ref}", ref.Ref)
+	return sourceTemplate{Dir: r.Replace(t.Dir), File: r.Replace(t.File)}
+}
+
+// SourceLinks returns the go-source directory and file URL patterns of repo.
+func (repo *Repo) SourceLinks() sourceTemplate {
+	return source.Expand(sourceRef{Root: repo.SourceRootURL(), Ref: repo.GitTree()})
+}
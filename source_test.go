@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSourceTemplate(t *testing.T) {
+	defer func(t sourceTemplate) { source = t }(source)
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v0.1.0^{}",
+	))
+	repoURL := root.repoURL.String() + "/db"
+
+	tests := []struct {
+		template string
+		dir      string
+		file     string
+	}{{
+		"github",
+		repoURL + "/tree/master{/dir}",
+		repoURL + "/blob/master{/dir}/{file}#L{line}",
+	}, {
+		"gitlab",
+		repoURL + "/-/tree/master{/dir}",
+		repoURL + "/-/blob/master{/dir}/{file}#L{line}",
+	}, {
+		"gitea",
+		repoURL + "/src/master{/dir}",
+		repoURL + "/src/master{/dir}/{file}#L{line}",
+	}, {
+		"{root}/files/{ref}{/dir} {root}/files/{ref}{/dir}/{file}?line={line}",
+		repoURL + "/files/master{/dir}",
+		repoURL + "/files/master{/dir}/{file}?line={line}",
+	}}
+
+	for _, test := range tests {
+		var err error
+		source, err = parseSourceTemplate(test.template)
+		if err != nil {
+			t.Fatalf("%s: %v", test.template, err)
+		}
+		resp := serve(root, "/db?go-get=1")
+		want := `<meta name="go-source" content="upper.io/db _ ` + test.dir + ` ` + test.file + `">`
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Fatalf("%s: missing %s in:\n%s", test.template, want, resp.Body)
+		}
+	}
+
+	if _, err := parseSourceTemplate("bitbucket"); err == nil {
+		t.Fatalf("accepted an unknown layout")
+	}
+}
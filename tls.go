@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// server is an HTTP server together with the listener it serves on.
+type server struct {
+	*http.Server
+	listener net.Listener
+}
+
+// serve accepts connections until the listener fails.
+func (s *server) serve() error {
+	if s.TLSConfig != nil {
+		return s.ServeTLS(s.listener, "", "")
+	}
+	return s.Serve(s.listener)
+}
+
+// newServers creates the servers run() starts: handler served over HTTP at
+// -addr or -socket or, with -tls-domains, handler served over HTTPS at
+// -tls-addr with certificates from Let's Encrypt, and an HTTP server at -addr
+// that answers ACME challenges and redirects everything else to HTTPS.
+//
+// The handler is mounted on a ServeMux, which redirects requests for unclean
+// paths (e.g.: /db.v1/../orm.v1) to their clean form before they reach it.
+func newServers(handler http.Handler) ([]*server, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	handler = mux
+
+	domains := splitList(*tlsDomainsFlag)
+	if len(domains) == 0 {
+		li, err := listenFlags()
+		if err != nil {
+			return nil, err
+		}
+		return []*server{{&http.Server{Handler: handler}, li}}, nil
+	}
+
+	if *socketFlag != "" {
+		return nil, fmt.Errorf("-tls-domains cannot be combined with -socket")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+	}
+	if *tlsCacheDirFlag != "" {
+		m.Cache = autocert.DirCache(*tlsCacheDirFlag)
+	}
+
+	tlsLi, err := listen("tcp", *tlsAddrFlag, *maxConnsFlag)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to bind to tcp %s: %v", *tlsAddrFlag, err)
+	}
+	li, err := listenFlags()
+	if err != nil {
+		tlsLi.Close()
+		return nil, err
+	}
+
+	return []*server{
+		{&http.Server{Handler: handler, TLSConfig: m.TLSConfig()}, tlsLi},
+		{&http.Server{Handler: m.HTTPHandler(httpsRedirect(*tlsAddrFlag))}, li},
+	}, nil
+}
+
+// listenFlags listens at -addr or -socket.
+func listenFlags() (net.Listener, error) {
+	listenNet, listenAddr := "tcp", *addrFlag
+	if *socketFlag != "" {
+		listenNet, listenAddr = "unix", *socketFlag
+	}
+	li, err := listen(listenNet, listenAddr, *maxConnsFlag)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to bind to %s %s: %v", listenNet, listenAddr, err)
+	}
+	return li, nil
+}
+
+// httpsRedirect returns a handler that redirects requests to the same URL
+// over HTTPS, on the port of tlsAddr.
+func httpsRedirect(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		target := "https://" + host + req.URL.RequestURI()
+		http.Redirect(resp, req, target, http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		tlsAddr string
+		target  string
+		want    string
+	}{
+		{":443", "http://upper.io/db.v4?go-get=1", "https://upper.io/db.v4?go-get=1"},
+		{":443", "http://upper.io:80/db", "https://upper.io/db"},
+		{":8443", "http://upper.io/db", "https://upper.io:8443/db"},
+		{"127.0.0.1:8443", "http://upper.io:8080/db/info/refs?service=git-upload-pack", "https://upper.io:8443/db/info/refs?service=git-upload-pack"},
+		{":8443", "http://[::1]:8080/db", "https://[::1]:8443/db"},
+	}
+
+	for _, test := range tests {
+		resp := httptest.NewRecorder()
+		httpsRedirect(test.tlsAddr).ServeHTTP(resp, httptest.NewRequest("GET", test.target, nil))
+		if resp.Code != http.StatusMovedPermanently {
+			t.Fatalf("%s: got status %d", test.target, resp.Code)
+		}
+		if loc := resp.Header().Get("Location"); loc != test.want {
+			t.Fatalf("%s: got Location %q, want %q", test.target, loc, test.want)
+		}
+	}
+}
+
+func TestNewServers(t *testing.T) {
+	defer func(addr, domains, tlsAddr string) {
+		*addrFlag, *tlsDomainsFlag, *tlsAddrFlag = addr, domains, tlsAddr
+	}(*addrFlag, *tlsDomainsFlag, *tlsAddrFlag)
+	*addrFlag, *tlsAddrFlag = "127.0.0.1:0", "127.0.0.1:0"
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	*tlsDomainsFlag = ""
+	servers, err := newServers(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].TLSConfig != nil {
+		t.Fatalf("got %d servers without -tls-domains, want a single plain one", len(servers))
+	}
+	servers[0].listener.Close()
+
+	*tlsDomainsFlag = "upper.io, www.upper.io"
+	servers, err = newServers(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		defer s.listener.Close()
+	}
+	if len(servers) != 2 {
+		t.Fatalf("got %d servers with -tls-domains, want 2", len(servers))
+	}
+	if servers[0].TLSConfig == nil || servers[0].TLSConfig.GetCertificate == nil {
+		t.Fatalf("HTTPS server has no certificate source")
+	}
+
+	resp := httptest.NewRecorder()
+	servers[1].Handler.ServeHTTP(resp, httptest.NewRequest("GET", "http://upper.io/db", nil))
+	if resp.Code != http.StatusMovedPermanently {
+		t.Fatalf("HTTP server did not redirect, got status %d", resp.Code)
+	}
+}
+
+func TestNewServersCleanPaths(t *testing.T) {
+	defer func(addr, domains string) {
+		*addrFlag, *tlsDomainsFlag = addr, domains
+	}(*addrFlag, *tlsDomainsFlag)
+	*addrFlag, *tlsDomainsFlag = "127.0.0.1:0", ""
+
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v1.0.0^{}",
+	))
+	servers, err := newServers(http.HandlerFunc(newHandler(root)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer servers[0].listener.Close()
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/db.v1/../orm.v1?go-get=1", "/orm.v1?go-get=1"},
+		{"/db.v1/objects/../../../etc/passwd", "/etc/passwd"},
+		{"/db.v1/./mongo?go-get=1", "/db.v1/mongo?go-get=1"},
+	}
+	for _, test := range tests {
+		resp := httptest.NewRecorder()
+		servers[0].Handler.ServeHTTP(resp, httptest.NewRequest("GET", test.target, nil))
+		if resp.Code < 300 || resp.Code >= 400 {
+			t.Fatalf("%s: got status %d, want a redirect", test.target, resp.Code)
+		}
+		if loc := resp.Header().Get("Location"); loc != test.want {
+			t.Fatalf("%s: got Location %q, want %q", test.target, loc, test.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// versionsSuffix is the path, after the package, of the versions endpoint,
+// which is also served with a ?versions query.
+const versionsSuffix = "/@versions"
+
+// versionsInfo is the JSON body of the versions endpoint.
+type versionsInfo struct {
+	// Versions holds every version found, in ascending order.
+	Versions []string `json:"versions"`
+
+	// Selected is the version the request resolves to, if any.
+	Selected string `json:"selected,omitempty"`
+
+	// GitTree is the branch or tag source links point to.
+	GitTree string `json:"git_tree"`
+}
+
+// serveVersions answers with the versions of repo, after SetVersions.
+func serveVersions(resp http.ResponseWriter, repo *Repo) {
+	all := make(semver.Versions, len(repo.AllVersions))
+	copy(all, repo.AllVersions)
+	sort.Sort(all)
+
+	info := versionsInfo{
+		Versions: []string{},
+		Selected: repo.ResolvedVersionString(),
+		GitTree:  repo.GitTree(),
+	}
+	for _, v := range all {
+		s := versionString(v)
+		if n := len(info.Versions); n == 0 || info.Versions[n-1] != s {
+			info.Versions = append(info.Versions, s)
+		}
+	}
+	sendJSON(resp, info)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVersionsEndpoint(t *testing.T) {
+	root := fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v2.1.0^{}",
+		testHash("3")+" refs/tags/v1.0.0^{}",
+		testHash("4")+" refs/tags/v2.0.0^{}",
+		testHash("5")+" refs/tags/v2.0.1^{}",
+	))
+
+	tests := []struct {
+		summary  string
+		path     string
+		selected string
+	}{
+		{"Query form", "/db.v2?versions", "v2.1.0"},
+		{"Path form", "/db.v2/@versions", "v2.1.0"},
+		{"Pinned minor", "/db.v2.0/@versions", "v2.0.1"},
+		{"Other major", "/db.v1?versions", "v1.0.0"},
+	}
+
+	for _, test := range tests {
+		resp := serve(root, test.path)
+		if resp.Code != 200 {
+			t.Fatalf("%s: unexpected status %d: %s", test.summary, resp.Code, resp.Body)
+		}
+		if ct := resp.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%s: got Content-Type %q", test.summary, ct)
+		}
+
+		var info map[string]interface{}
+		if err := json.Unmarshal(resp.Body.Bytes(), &info); err != nil {
+			t.Fatalf("%s: %v", test.summary, err)
+		}
+		versions, _ := info["versions"].([]interface{})
+		want := []string{"v1.0.0", "v2.0.0", "v2.0.1", "v2.1.0"}
+		if len(versions) != len(want) {
+			t.Fatalf("%s: got versions %v, want %v", test.summary, versions, want)
+		}
+		for i := range want {
+			if versions[i] != want[i] {
+				t.Fatalf("%s: got versions %v, want %v", test.summary, versions, want)
+			}
+		}
+		if info["selected"] != test.selected {
+			t.Fatalf("%s: got selected %v, want %s", test.summary, info["selected"], test.selected)
+		}
+		if _, ok := info["git_tree"].(string); !ok {
+			t.Fatalf("%s: missing git_tree in %s", test.summary, resp.Body)
+		}
+	}
+
+	if resp := serve(root, "/db.v3?versions"); resp.Code != 404 {
+		t.Fatalf("missing major: got status %d", resp.Code)
+	}
+
+	// Without v0 or v1, unversioned requests resolve to nothing, but the
+	// versions are still listed.
+	root = fakeUpstream(t, reflines(
+		testHash("1")+" HEAD",
+		testHash("2")+" refs/tags/v2.0.0^{}",
+		testHash("3")+" refs/tags/v3.0.0^{}",
+	))
+	for _, path := range []string{"/db/@versions", "/db?versions"} {
+		resp := serve(root, path)
+		if resp.Code != 200 {
+			t.Fatalf("%s: unexpected status %d: %s", path, resp.Code, resp.Body)
+		}
+		var info versionsInfo
+		if err := json.Unmarshal(resp.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		if len(info.Versions) != 2 || info.Versions[0] != "v2.0.0" || info.Selected != "" {
+			t.Fatalf("%s: unexpected versions %s", path, resp.Body)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// serveModuleZip answers with the zip of module, from repo, at version, built
+// from the upstream archive of commit.
+func serveModuleZip(resp http.ResponseWriter, repo *Repo, module, version, commit string) {
+	// The zip is built in a temporary file rather than in memory, and only
+	// sent once complete, so failures still get a proper status.
+	f, err := ioutil.TempFile("", "vanity-*.zip")
+	if err != nil {
+		sendError(resp, "Failed to create module zip: %v", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := buildModuleZip(f, repo, module+"@"+version, commit); err != nil {
+		writeBody(resp, http.StatusBadGateway, []byte(fmt.Sprintf("Cannot obtain archive from Git: %v", err)))
+		return
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		sendError(resp, "Failed to read module zip: %v", err)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/zip")
+	resp.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	resp.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(resp, f); err != nil {
+		repo.Log().Error(fmt.Sprintf("Zip: %v", err))
+	}
+}
+
+// The limits of module zips, as in golang.org/x/mod/zip.
+const (
+	maxModuleZipSize = 500 << 20
+	maxGoModSize     = 16 << 20
+	maxLicenseSize   = 16 << 20
+)
+
+// buildModuleZip writes to w a module zip holding the files of the upstream
+// archive of commit under the prefix dir (e.g.: upper.io/db.v4@v4.1.0). The
+// archive is read with the -archive-url template and kept in a temporary
+// file, as moduleFiles needs all of its names before any file is written.
+func buildModuleZip(w io.Writer, repo *Repo, dir, commit string) error {
+	archiveURL := strings.NewReplacer(
+		"{repo}", repo.RepoRootURL(),
+		"{ref}", commit,
+	).Replace(*archiveURLFlag)
+
+	resp, err := httpClient.Get(archiveURL)
+	if err != nil {
+		return fmt.Errorf("cannot talk to git repository: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("error from git repository: %v", resp.Status)
+	}
+
+	f, err := ioutil.TempFile("", "vanity-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("cannot read archive: %v", err)
+	}
+
+	var files []archiveFile
+	err = walkArchive(f, func(name string, hdr *tar.Header, r io.Reader) error {
+		files = append(files, archiveFile{name, hdr.Size})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	include, err := moduleFiles(files)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	err = walkArchive(f, func(name string, hdr *tar.Header, r io.Reader) error {
+		if !include[name] {
+			return nil
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     dir + "/" + name,
+			Method:   zip.Deflate,
+			Modified: hdr.ModTime,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fw, r); err != nil {
+			return fmt.Errorf("cannot read archive: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// walkArchive calls fn with the regular files of the tar.gz archive in f, from
+// its start, by their path below the single top-level directory archives keep
+// everything under (e.g.: db-<commit>/).
+func walkArchive(f *os.File, fn func(name string, hdr *tar.Header, r io.Reader) error) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("cannot read archive: %v", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue // Module zips only hold regular files.
+		}
+		i := strings.IndexByte(hdr.Name, '/')
+		if i < 0 {
+			continue
+		}
+		if err := fn(hdr.Name[i+1:], hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveFile is a regular file of an upstream archive, by its path in the
+// module.
+type archiveFile struct {
+	name string
+	size int64
+}
+
+// moduleFiles returns the files that belong in the module zip, following the
+// rules of golang.org/x/mod/zip so that the zip hashes like the one the go
+// command builds: files of vendored packages and nested modules (directories
+// with their own go.mod) are left out, and invalid paths, case-insensitive
+// collisions and files or modules over the size limits are errors.
+func moduleFiles(files []archiveFile) (map[string]bool, error) {
+	modDirs := map[string]bool{}
+	for _, f := range files {
+		if path.Base(f.name) == "go.mod" && f.name != "go.mod" {
+			modDirs[path.Dir(f.name)] = true
+		}
+	}
+	inNestedModule := func(name string) bool {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if modDirs[dir] {
+				return true
+			}
+		}
+		return false
+	}
+
+	include := map[string]bool{}
+	seen := map[string]moduleEntry{}
+	var total int64
+	for _, f := range files {
+		switch {
+		case f.name != path.Clean(f.name) || path.IsAbs(f.name):
+			return nil, fmt.Errorf("malformed file path %q", f.name)
+		case isVendoredPackage(f.name), inNestedModule(f.name), f.name == ".hg_archival.txt":
+			continue
+		}
+		if err := checkFilePath(f.name); err != nil {
+			return nil, fmt.Errorf("malformed file path %q: %v", f.name, err)
+		}
+		if strings.ToLower(f.name) == "go.mod" && f.name != "go.mod" {
+			return nil, fmt.Errorf("go.mod file not in module root directory: %q", f.name)
+		}
+		if err := checkCollision(seen, f.name, false); err != nil {
+			return nil, err
+		}
+		if total += f.size; total > maxModuleZipSize {
+			return nil, fmt.Errorf("module source tree too large (max size is %d bytes)", maxModuleZipSize)
+		}
+		if f.name == "go.mod" && f.size > maxGoModSize {
+			return nil, fmt.Errorf("go.mod file too large (max size is %d bytes)", maxGoModSize)
+		}
+		if f.name == "LICENSE" && f.size > maxLicenseSize {
+			return nil, fmt.Errorf("LICENSE file too large (max size is %d bytes)", maxLicenseSize)
+		}
+		include[f.name] = true
+	}
+	return include, nil
+}
+
+// isVendoredPackage reports whether name is a file of a vendored package,
+// which only leaves the files right in the top-level vendor directory (e.g.:
+// vendor/modules.txt). It keeps the offset golang.org/x/mod/zip uses for
+// nested vendor directories, as changing it would change module hashes.
+func isVendoredPackage(name string) bool {
+	var i int
+	if strings.HasPrefix(name, "vendor/") {
+		i += len("vendor/")
+	} else if j := strings.Index(name, "/vendor/"); j >= 0 {
+		i += len("/vendor/")
+	} else {
+		return false
+	}
+	return strings.Contains(name[i:], "/")
+}
+
+// moduleEntry is a path of a module zip, seen by checkCollision.
+type moduleEntry struct {
+	name  string
+	isDir bool
+}
+
+// checkCollision records name, and its parent directories, in seen, failing
+// if it collides with a path recorded before when case is ignored.
+func checkCollision(seen map[string]moduleEntry, name string, isDir bool) error {
+	fold := strings.ToLower(name)
+	if other, ok := seen[fold]; ok {
+		switch {
+		case other.name != name:
+			return fmt.Errorf("case-insensitive file name collision: %q and %q", other.name, name)
+		case other.isDir != isDir:
+			return fmt.Errorf("entry %q is both a file and a directory", name)
+		case !isDir:
+			return fmt.Errorf("multiple entries for file %q", name)
+		}
+	} else {
+		seen[fold] = moduleEntry{name, isDir}
+	}
+	if dir := path.Dir(name); dir != "." {
+		return checkCollision(seen, dir, true)
+	}
+	return nil
+}
+
+// badWindowsNames are the path elements Windows reserves, which module
+// files cannot use.
+var badWindowsNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// checkFilePath checks that name is a valid file path within a module, as
+// golang.org/x/mod/module.CheckFilePath does.
+func checkFilePath(name string) error {
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("invalid UTF-8")
+	}
+	if name == "" || strings.HasSuffix(name, "/") || strings.Contains(name, "//") {
+		return fmt.Errorf("empty path element")
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if strings.Count(elem, ".") == len(elem) {
+			return fmt.Errorf("invalid path element %q", elem)
+		}
+		if strings.HasSuffix(elem, ".") {
+			return fmt.Errorf("trailing dot in path element")
+		}
+		for _, r := range elem {
+			if !fileNameRuneOK(r) {
+				return fmt.Errorf("invalid char %q", r)
+			}
+		}
+		short := elem
+		if i := strings.IndexByte(short, '.'); i >= 0 {
+			short = short[:i]
+		}
+		for _, bad := range badWindowsNames {
+			if strings.EqualFold(bad, short) {
+				return fmt.Errorf("%q disallowed as path element component on Windows", short)
+			}
+		}
+	}
+	return nil
+}
+
+// fileNameRuneOK reports whether r may appear in a module file name: letters,
+// digits and the ASCII punctuation that is safe on every file system.
+func fileNameRuneOK(r rune) bool {
+	if r < utf8.RuneSelf {
+		return '0' <= r && r <= '9' || 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' ||
+			strings.ContainsRune("!#$%&()+,-.=@[]^_{}~ ", r)
+	}
+	return unicode.IsLetter(r)
+}